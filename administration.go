@@ -14,16 +14,15 @@ func FlushIndex(idx int, options Options) error {
 	if err != nil {
 		return err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	if options.Verbose {
-		logClientErrors(client.LogString())
 		log.Printf("index flushed: %s\n", resp.Status)
 	}
-	return nil
+	return resp.Body.Close()
 }
 
 // GetSettings fetches the settings of the index.
@@ -35,16 +34,12 @@ func GetSettings(idx int, options Options) (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
-	defer resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
-
-	if options.Verbose {
-		logClientErrors(client.LogString())
-	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("could not get settings: %s", link)
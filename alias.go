@@ -0,0 +1,216 @@
+package esbulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// previousAlias returns the alias, that marks indexes, which held an alias
+// before a swap, so they can be deleted later, even if they were kept for a
+// while.
+func previousAlias(alias string) string {
+	return alias + "-previous"
+}
+
+// aliasAction is one action of an _aliases request.
+type aliasAction map[string]struct {
+	Index string `json:"index"`
+	Alias string `json:"alias,omitempty"`
+}
+
+func addAlias(index, alias string) aliasAction {
+	return aliasAction{"add": {Index: index, Alias: alias}}
+}
+
+func removeAlias(index, alias string) aliasAction {
+	return aliasAction{"remove": {Index: index, Alias: alias}}
+}
+
+// SwapAlias atomically points an alias at the given indexes and removes it
+// from all others. Indexes, that lose the alias, are marked with another
+// alias, named like the alias with a "-previous" suffix. Of all marked
+// indexes, the keepOld most recently created ones are kept, the others are
+// deleted; a negative keepOld keeps all of them.
+func SwapAlias(options Options, alias string, indexes []string, keepOld int) error {
+	if alias == "" || len(indexes) == 0 {
+		return fmt.Errorf("alias and indexes required")
+	}
+	previous := previousAlias(alias)
+	holders, err := getAliases(options, alias, previous)
+	if err != nil {
+		return err
+	}
+	isNew := make(map[string]bool)
+	for _, index := range indexes {
+		isNew[index] = true
+	}
+
+	var actions []aliasAction
+	var old []string
+	for _, index := range indexes {
+		actions = append(actions, addAlias(index, alias))
+		if holders[index][previous] {
+			actions = append(actions, removeAlias(index, previous))
+		}
+	}
+	var names []string
+	for index := range holders {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	for _, index := range names {
+		if isNew[index] {
+			continue
+		}
+		aliases := holders[index]
+		if aliases[alias] {
+			actions = append(actions, removeAlias(index, alias))
+			if !aliases[previous] {
+				actions = append(actions, addAlias(index, previous))
+			}
+		}
+		old = append(old, index)
+	}
+	if err := updateAliases(options, actions); err != nil {
+		return err
+	}
+	if options.Verbose {
+		log.Printf("alias %s points to %s", alias, strings.Join(indexes, ", "))
+	}
+	if keepOld < 0 || len(old) <= keepOld {
+		return nil
+	}
+
+	// Keep the most recently created indexes.
+	created, err := creationDates(options, old)
+	if err != nil {
+		return err
+	}
+	sort.Slice(old, func(i, j int) bool {
+		if created[old[i]] != created[old[j]] {
+			return created[old[i]] > created[old[j]]
+		}
+		return old[i] > old[j]
+	})
+	for _, index := range old[keepOld:] {
+		opts := options
+		opts.Index = index
+		if err := DeleteIndex(opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAliases returns the indexes, that hold any of the given aliases, and
+// which of them they hold.
+func getAliases(options Options, aliases ...string) (map[string]map[string]bool, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_alias/%s", server, strings.Join(aliases, ","))
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// A missing alias is reported with 404, along with the aliases found.
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get alias %s with %s: %s", aliases[0], resp.Status, buf.String())
+	}
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode aliases: %v", err)
+	}
+	holders := make(map[string]map[string]bool)
+	for index, raw := range doc {
+		var v struct {
+			Aliases map[string]json.RawMessage `json:"aliases"`
+		}
+		// Skip "error" and "status", which come with a 404.
+		if err := json.Unmarshal(raw, &v); err != nil || v.Aliases == nil {
+			continue
+		}
+		holders[index] = make(map[string]bool)
+		for name := range v.Aliases {
+			holders[index][name] = true
+		}
+	}
+	return holders, nil
+}
+
+// updateAliases performs alias actions in one atomic request.
+func updateAliases(options Options, actions []aliasAction) error {
+	b, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	server := PickServerURI(options.Servers)
+	req, err := MakeHTTPRequest(options, "POST", server+"/_aliases", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to update aliases with %s: %s", resp.Status, buf.String())
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// creationDates returns the creation dates of indexes, in milliseconds since
+// the epoch.
+func creationDates(options Options, indexes []string) (map[string]int64, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/%s/_settings/index.creation_date", server, strings.Join(indexes, ","))
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("could not get settings: %s", link)
+	}
+	var doc map[string]struct {
+		Settings struct {
+			Index struct {
+				CreationDate string `json:"creation_date"`
+			} `json:"index"`
+		} `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode settings: %v", err)
+	}
+	created := make(map[string]int64)
+	for index, v := range doc {
+		created[index], _ = strconv.ParseInt(v.Settings.Index.CreationDate, 10, 64)
+	}
+	return created, nil
+}
@@ -0,0 +1,92 @@
+package esbulk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSwapAlias(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		actions  string
+		requests []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+		switch {
+		case req.URL.Path == "/_alias/search,search-previous":
+			fmt.Fprint(rw, `{
+				"search-3": {"aliases": {"search": {}}},
+				"search-2": {"aliases": {"search-previous": {}}},
+				"search-1": {"aliases": {"search-previous": {}}}
+			}`)
+		case req.URL.Path == "/_aliases":
+			actions = string(b)
+			fmt.Fprint(rw, `{"acknowledged": true}`)
+		case strings.HasSuffix(req.URL.Path, "/_settings/index.creation_date"):
+			fmt.Fprint(rw, `{
+				"search-1": {"settings": {"index": {"creation_date": "100"}}},
+				"search-2": {"settings": {"index": {"creation_date": "200"}}},
+				"search-3": {"settings": {"index": {"creation_date": "300"}}}
+			}`)
+		default:
+			fmt.Fprint(rw, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	options := Options{Servers: []string{server.URL}, MaxRetries: 1}
+	if err := SwapAlias(options, "search", []string{"search-4"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"actions":[{"add":{"index":"search-4","alias":"search"}},` +
+		`{"remove":{"index":"search-3","alias":"search"}},{"add":{"index":"search-3","alias":"search-previous"}}]}`
+	if actions != want {
+		t.Errorf("got actions %s, want %s", actions, want)
+	}
+	var deleted []string
+	for _, r := range requests {
+		if strings.HasPrefix(r, "DELETE ") {
+			deleted = append(deleted, strings.TrimPrefix(r, "DELETE /"))
+		}
+	}
+	if strings.Join(deleted, " ") != "search-2 search-1" {
+		t.Errorf("expected the oldest indexes to be deleted, got %v", requests)
+	}
+}
+
+func TestCreateIndexFromLDJFileAlias(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.NumWorkers = 1
+	options.Alias = "example"
+
+	if _, err := CreateIndexFromLDJFile(strings.NewReader("{\"a\": 1}\n"), options); err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	for _, r := range cluster.requests {
+		if !strings.HasPrefix(r, "GET /_alias/") {
+			last = r
+		}
+	}
+	if !strings.HasPrefix(last, `POST /_aliases {"actions":[{"add":{"index":"exampleIndex","alias":"example"}}]}`) {
+		t.Errorf("expected the alias to be swapped last, got %v", cluster.requests)
+	}
+
+	options.Index = "events-{ts:2006}"
+	if _, err := CreateIndexFromLDJFile(strings.NewReader("{\"a\": 1}\n"), options); err == nil {
+		t.Error("expected an error for an alias with an index template")
+	}
+}
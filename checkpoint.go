@@ -0,0 +1,189 @@
+package esbulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint is a position in an input file, up to which all documents have
+// been indexed.
+type Checkpoint struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"` // Byte offset in the (uncompressed) input.
+	Lines  int64  `json:"lines"`
+}
+
+// Checkpointer keeps track of indexed documents and periodically writes the
+// highest position, up to which all documents have been indexed, to a file.
+// Since workers complete batches out of order, documents acknowledged ahead of
+// that position are kept until the gap before them is closed.
+type Checkpointer struct {
+	mu       sync.Mutex
+	path     string
+	file     string
+	interval time.Duration
+	saved    time.Time
+	start    Checkpoint
+	current  Checkpoint
+	next     int64              // Sequence number of the next document to complete the position.
+	pending  map[int64]Document // Acknowledged documents beyond the position.
+	others   []Checkpoint       // Positions in other input files, kept in the checkpoint file.
+	loaded   bool               // Whether others have been read.
+}
+
+// NewCheckpointer creates a checkpointer for an input file, that writes to
+// path at most once per interval.
+func NewCheckpointer(path, file string, interval time.Duration) *Checkpointer {
+	c := Checkpoint{File: file}
+	return &Checkpointer{
+		path:     path,
+		file:     file,
+		interval: interval,
+		start:    c,
+		current:  c,
+		pending:  make(map[int64]Document),
+	}
+}
+
+// Resume reads the checkpoint file, so indexing continues after the recorded
+// position. If there is no checkpoint file yet, or if it has no position for
+// the input file, indexing starts at the beginning.
+func (c *Checkpointer) Resume() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	all, err := c.load()
+	if err != nil {
+		return err
+	}
+	for _, cp := range all {
+		if cp.File == c.file {
+			c.start, c.current = cp, cp
+			return nil
+		}
+	}
+	if len(all) > 0 {
+		log.Printf("no checkpoint for %q, starting from the beginning", c.file)
+	}
+	return nil
+}
+
+// load reads all positions from the checkpoint file, one per line, and keeps
+// those in other input files, so they are written back along with this one.
+// Input files loaded in turn, like a directory, each have their own position.
+func (c *Checkpointer) load() ([]Checkpoint, error) {
+	c.loaded = true
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []Checkpoint
+	c.others = nil
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var cp Checkpoint
+		if err := json.Unmarshal([]byte(line), &cp); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint file %s: %v", c.path, err)
+		}
+		all = append(all, cp)
+		if cp.File != c.file {
+			c.others = append(c.others, cp)
+		}
+	}
+	return all, nil
+}
+
+// Start returns the position to start reading from.
+func (c *Checkpointer) Start() Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.start
+}
+
+// Position returns the position, up to which all documents have been indexed.
+func (c *Checkpointer) Position() Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// Ack marks documents as indexed and writes the checkpoint file, if the last
+// write is older than the interval.
+func (c *Checkpointer) Ack(docs []Document) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, doc := range docs {
+		c.pending[doc.Seq] = Document{Line: doc.Line, Offset: doc.Offset}
+	}
+	for {
+		doc, ok := c.pending[c.next]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.next)
+		c.current.Offset, c.current.Lines = doc.Offset, doc.Line
+		c.next++
+	}
+	if time.Since(c.saved) < c.interval {
+		return nil
+	}
+	return c.save()
+}
+
+// Save writes the checkpoint file.
+func (c *Checkpointer) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+// save writes the current position, along with those in other input files,
+// to a temporary file first, so an existing checkpoint is never left half
+// written.
+func (c *Checkpointer) save() error {
+	if !c.loaded {
+		if _, err := c.load(); err != nil {
+			log.Printf("%v, replacing it", err)
+		}
+	}
+	var buf bytes.Buffer
+	for _, cp := range append(c.others, c.current) {
+		line, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	b := buf.Bytes()
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.saved = time.Now()
+	return nil
+}
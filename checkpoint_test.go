@@ -0,0 +1,147 @@
+package esbulk
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointerOutOfOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cp := NewCheckpointer(filepath.Join(dir, "cp.json"), "input.ldj", 0)
+	docs := []Document{
+		{Seq: 0, Line: 1, Offset: 10},
+		{Seq: 1, Line: 3, Offset: 25},
+		{Seq: 2, Line: 4, Offset: 30},
+		{Seq: 3, Line: 5, Offset: 42},
+	}
+
+	if err := cp.Ack([]Document{docs[1], docs[3]}); err != nil {
+		t.Fatal(err)
+	}
+	if pos := cp.Position(); pos.Lines != 0 {
+		t.Errorf("Expected no progress before the first document, got %v", pos)
+	}
+	if err := cp.Ack(docs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if pos := cp.Position(); pos.Lines != 3 || pos.Offset != 25 {
+		t.Errorf("Expected position at line 3, got %v", pos)
+	}
+	if err := cp.Ack(docs[2:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := NewCheckpointer(filepath.Join(dir, "cp.json"), "input.ldj", 0)
+	if err := resumed.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if start := resumed.Start(); start != (Checkpoint{File: "input.ldj", Offset: 42, Lines: 5}) {
+		t.Errorf("Expected to resume after line 5, got %v", start)
+	}
+
+	other := NewCheckpointer(filepath.Join(dir, "cp.json"), "other.ldj", 0)
+	if err := other.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if start := other.Start(); start.Lines != 0 {
+		t.Errorf("Expected another file to start at the beginning, got %v", start)
+	}
+}
+
+func TestCheckpointerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Interrupted in the second file, like with -dir.
+	path := filepath.Join(dir, "cp.json")
+	if err := ioutil.WriteFile(path, []byte(`{"file": "b.ldj", "offset": 30, "lines": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		file  string
+		start int64
+	}{{"a.ldj", 0}, {"b.ldj", 3}} {
+		cp := NewCheckpointer(path, c.file, 0)
+		if err := cp.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		if start := cp.Start(); start.Lines != c.start {
+			t.Errorf("%s: expected to start after line %d, got %v", c.file, c.start, start)
+		}
+		if err := cp.Ack([]Document{{Seq: 0, Line: 5, Offset: 50}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"file":"a.ldj","offset":50,"lines":5}` + "\n" + `{"file":"b.ldj","offset":50,"lines":5}` + "\n"
+	if string(b) != want {
+		t.Errorf("got checkpoint file %q, want %q", b, want)
+	}
+}
+
+func TestCreateIndexFromLDJFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := "{\"a\": 1}\n\n{\"a\": 2}\n{\"a\": 3}\n{\"a\": 4}"
+	path := filepath.Join(dir, "cp.json")
+	if err := ioutil.WriteFile(path, []byte(`{"file": "input.ldj", "offset": 19, "lines": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader, that cannot seek, has to skip lines.
+	for _, r := range []io.Reader{
+		strings.NewReader(input),
+		ioutil.NopCloser(strings.NewReader(input)),
+	} {
+		cluster := newTestCluster()
+
+		cp := NewCheckpointer(path, "input.ldj", 0)
+		if err := cp.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		options := getDefaultOptions([]string{cluster.URL})
+		options.NumWorkers = 1
+		options.BatchSize = 10
+		options.Checkpoint = cp
+
+		count, err := CreateIndexFromLDJFile(r, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("Expected 2 documents after resuming, got %d", count)
+		}
+		bulk := cluster.find("POST /_bulk")
+		if len(bulk) != 1 || strings.Contains(bulk[0], `{"a": 2}`) || !strings.Contains(bulk[0], `{"a": 4}`) {
+			t.Errorf("Expected only documents after line 3, got %q", bulk)
+		}
+		if pos := cp.Position(); pos.Lines != 5 || pos.Offset != int64(len(input)) {
+			t.Errorf("Expected position at the end of input, got %v", pos)
+		}
+		cluster.Close()
+
+		// Reset the checkpoint file for the next reader.
+		if err := ioutil.WriteFile(path, []byte(`{"file": "input.ldj", "offset": 19, "lines": 3}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
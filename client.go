@@ -0,0 +1,108 @@
+package esbulk
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/pester"
+)
+
+// Defaults for the shared HTTP client, used if the options leave them unset.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// clientConfig are the options, that make up an HTTP client.
+type clientConfig struct {
+	maxRetries          int
+	maxIdleConnsPerHost int
+	requestTimeout      time.Duration
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	verbose             bool
+}
+
+// clients are created once per configuration and shared, so connections are
+// kept alive and reused across workers and requests.
+var clients = struct {
+	sync.Mutex
+	m map[clientConfig]*pester.Client
+}{m: make(map[clientConfig]*pester.Client)}
+
+// httpClient returns the shared client for the HTTP related options.
+func httpClient(options Options) *pester.Client {
+	c := clientConfig{
+		maxRetries:          options.MaxRetries,
+		maxIdleConnsPerHost: options.MaxIdleConnsPerHost,
+		requestTimeout:      options.RequestTimeout,
+		dialTimeout:         options.DialTimeout,
+		tlsHandshakeTimeout: options.TLSHandshakeTimeout,
+		verbose:             options.Verbose,
+	}
+	// Every worker should be able to keep its connection.
+	if c.maxIdleConnsPerHost <= 0 {
+		c.maxIdleConnsPerHost = options.NumWorkers
+	}
+	if c.maxIdleConnsPerHost < http.DefaultMaxIdleConnsPerHost {
+		c.maxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	if c.dialTimeout <= 0 {
+		c.dialTimeout = defaultDialTimeout
+	}
+	if c.tlsHandshakeTimeout <= 0 {
+		c.tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	clients.Lock()
+	defer clients.Unlock()
+	if client, ok := clients.m[c]; ok {
+		return client
+	}
+	client := newHTTPClient(c)
+	clients.m[c] = client
+	return client
+}
+
+// newHTTPClient returns a client with exponential backoff logic on top of a
+// pooled transport. HTTP/2 is used, if the server supports it.
+func newHTTPClient(c clientConfig) *pester.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   c.tlsHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	client := pester.NewExtendedClient(&http.Client{
+		Transport: transport,
+		Timeout:   c.requestTimeout,
+	})
+	client.Concurrency = 1
+	client.MaxRetries = c.maxRetries
+	client.Backoff = pester.ExponentialBackoff
+	// A shared client would keep a log of all failed attempts of the run,
+	// so they are logged right away instead.
+	if c.verbose {
+		client.LogHook = logClientError
+	}
+	return client
+}
+
+// logClientError logs a failed attempt of the HTTP client.
+func logClientError(e pester.ErrEntry) {
+	if e.Err == nil {
+		log.Printf("%s %s failed with a server error (attempt %d)", e.Verb, e.URL, e.Attempt)
+		return
+	}
+	log.Printf("%s %s failed (attempt %d): %v", e.Verb, e.URL, e.Attempt, e.Err)
+}
@@ -0,0 +1,114 @@
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sethgrid/pester"
+)
+
+func TestHTTPClientShared(t *testing.T) {
+	options := Options{NumWorkers: 4, MaxRetries: 3}
+	if httpClient(options) != httpClient(options) {
+		t.Fatal("expected the same client for the same options")
+	}
+	options.RequestTimeout = 1
+	if httpClient(options) == httpClient(Options{NumWorkers: 4, MaxRetries: 3}) {
+		t.Fatal("expected another client for another timeout")
+	}
+}
+
+func TestHTTPClientReusesConnections(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"took": 1, "errors": false, "items": [{"index": {"status": 201}}]}`)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	options := Options{
+		Servers:       []string{ts.URL},
+		Index:         "test",
+		DocType:       "default",
+		NumWorkers:    1,
+		MaxRetries:    1,
+		ServerVersion: Version{Distribution: DistributionElasticsearch, Number: "6.8.0", Major: 6},
+	}
+	for i := 0; i < 20; i++ {
+		if err := BulkIndexContext(context.Background(), []string{`{"a": 1}`}, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("20 sequential requests used %d connections, want 1", n)
+	}
+}
+
+// benchmarkClient sends small bulk requests from 16 goroutines per CPU, like
+// many workers with small batches do, and reports the connections opened per
+// request. Between requests, connections are idle, while the next batch is
+// read; only so many idle connections are kept open.
+func benchmarkClient(b *testing.B, client func(Options) *pester.Client) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		// Indexing takes a while, so requests of the workers overlap.
+		time.Sleep(time.Millisecond)
+		fmt.Fprint(w, `{"took": 1, "errors": false, "items": [{"index": {"status": 201}}]}`)
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	options := Options{Servers: []string{ts.URL}, NumWorkers: 16, MaxRetries: 1}
+	body := `{"index": {"_index": "test"}}` + "\n" + `{"a": 1}` + "\n"
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, err := MakeHTTPRequest(options, "POST", ts.URL+"/_bulk", strings.NewReader(body))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			resp, err := client(options).Do(req)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			// Reading the next batch, the connection is idle meanwhile.
+			time.Sleep(time.Millisecond)
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt32(&conns))/float64(b.N), "conns/op")
+}
+
+// BenchmarkSharedClient uses the pooled client shared by all requests.
+func BenchmarkSharedClient(b *testing.B) { benchmarkClient(b, httpClient) }
+
+// BenchmarkClientPerRequest creates a client for every request, as esbulk
+// did before, which keeps only two idle connections per host.
+func BenchmarkClientPerRequest(b *testing.B) {
+	benchmarkClient(b, func(options Options) *pester.Client { return MakeHTTPClient(options.MaxRetries) })
+}
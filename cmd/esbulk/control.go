@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/idagio/esbulk"
+)
+
+// rateLimits is the representation of the current limits.
+type rateLimits struct {
+	DocsPerSec  float64 `json:"docs_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// controlHandler allows to inspect and change the rate limits of a running
+// load, e.g.
+//
+//	$ curl localhost:9876/rate
+//	$ curl -XPUT 'localhost:9876/rate?docs_per_sec=500&bytes_per_sec=1MB'
+//
+// Parameters, that are not given, are left unchanged, zero means no limit.
+func controlHandler(limiter *esbulk.RateLimiter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rate", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			docs, bytes := limiter.Limits()
+			if v := r.FormValue("docs_per_sec"); v != "" {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || f < 0 {
+					http.Error(w, fmt.Sprintf("invalid docs_per_sec: %s", v), http.StatusBadRequest)
+					return
+				}
+				docs = f
+			}
+			if v := r.FormValue("bytes_per_sec"); v != "" {
+				var size esbulk.ByteSize
+				if err := size.Set(v); err != nil {
+					http.Error(w, fmt.Sprintf("invalid bytes_per_sec: %s", v), http.StatusBadRequest)
+					return
+				}
+				bytes = float64(size)
+			}
+			limiter.SetLimits(docs, bytes)
+			log.Printf("rate limits changed to %v docs/s and %v bytes/s", docs, bytes)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		docs, bytes := limiter.Limits()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rateLimits{DocsPerSec: docs, BytesPerSec: bytes})
+	})
+	return mux
+}
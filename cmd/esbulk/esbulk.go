@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/idagio/esbulk"
@@ -19,6 +23,12 @@ import (
 // Version of application.
 const Version = "0.7.0"
 
+// Exit codes, besides 1, which is used for any other error.
+const (
+	exitInterrupted = 3 // Stopped by a signal, index settings have been restored.
+	exitAborted     = 4 // Stopped by a second signal, index settings may not be restored.
+)
+
 func main() {
 
 	var serverFlags esbulk.ArrayFlags
@@ -26,19 +36,68 @@ func main() {
 	version := flag.Bool("v", false, "prints current program version")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 	memprofile := flag.String("memprofile", "", "write heap profile to file")
-	indexName := flag.String("index", "", "index name")
+	indexName := flag.String("index", "", "index name, or a template like events-{@timestamp:2006.01.02}")
 	docType := flag.String("type", "default", "elasticsearch doc type")
 	flag.Var(&serverFlags, "server", "elasticsearch server, this works with https as well")
 	batchSize := flag.Int("size", 1000, "bulk batch size")
+	var batchBytes esbulk.ByteSize
+	flag.Var(&batchBytes, "size-bytes", "also send a batch when its bulk request, documents and headers, reaches this size, e.g. 10MB (default no limit)")
+	dropOversized := flag.Bool("drop-oversized", false, "treat documents larger than -size-bytes as failed (see -dead-letter), instead of sending them alone")
 	numWorkers := flag.Int("w", runtime.NumCPU(), "number of workers to use")
+	var maxBytesPerSec esbulk.ByteSize
+	maxDocsPerSec := flag.Float64("max-docs-per-sec", 0, "limit the number of documents sent per second, across all workers (default no limit)")
+	flag.Var(&maxBytesPerSec, "max-bytes-per-sec", "limit the number of bytes sent per second, e.g. 5MB (default no limit)")
+	control := flag.String("control", "", "listen on this address, e.g. localhost:9876, for changes to the rate limits while indexing")
+	adaptive := flag.Bool("adaptive", false, "adjust the number of bulk requests in flight to cluster back-pressure, up to -w")
 	verbose := flag.Bool("verbose", false, "output basic progress")
 	gzipped := flag.Bool("z", false, "unzip gz'd file on the fly")
 	mapping := flag.String("mapping", "", "mapping string or filename to apply before indexing")
 	purge := flag.Bool("purge", false, "purge any existing index before indexing")
 	idfield := flag.String("id", "", "name of field to use as id field, by default ids are autogenerated")
+	idSeparator := flag.String("id-separator", "", "separator between the values of multiple -id fields")
+	idTemplate := flag.String("id-template", "", "build ids from a template like '{tenant}:{user.id}', instead of -id")
+	idHash := flag.String("id-hash", "", "hash ids with sha1, xxhash or murmur3; without -id or -id-template the whole document is hashed")
+	idMissing := flag.String("id-missing", "error", "missing or null id fields: error, empty (use an empty string) or auto (let elasticsearch generate the id)")
+	idNonScalar := flag.String("id-non-scalar", "error", "objects or arrays as id fields: error or json (use the value as written)")
+	routingField := flag.String("routing-field", "", "name of field to use as routing value")
+	versionField := flag.String("version-field", "", "name of field to use as document version, see -version-type")
+	versionType := flag.String("version-type", "", "external or external_gte, to only replace documents with a lower (or equal) version")
+	ifSeqNoField := flag.String("if-seq-no-field", "", "name of field with the sequence number a document must have to be replaced, requires -if-primary-term-field")
+	ifPrimaryTermField := flag.String("if-primary-term-field", "", "name of field with the primary term a document must have to be replaced")
+	conflictsOK := flag.Bool("conflicts-ok", false, "count version conflicts, but do not treat them as failures")
+	pipeline := flag.String("pipeline", "", "ingest pipeline to send documents through, must exist unless -pipeline-definition is given")
+	pipelineField := flag.String("pipeline-field", "", "name of field with the ingest pipeline for a document, overrides -pipeline")
+	pipelineDefinition := flag.String("pipeline-definition", "", "pipeline definition string or filename to upload as -pipeline before indexing")
+	dataStream := flag.String("data-stream", "", "index into this data stream with create actions, instead of -index")
+	settings := flag.String("settings", "", "index settings or a whole create index body, string or filename, used with the mapping to create the index")
+	bulkSettings := flag.String("bulk-settings", "", "index settings string or filename to apply during indexing, besides refresh_interval -1, original values are restored afterwards")
+	shards := flag.Int("shards", 0, "number of primary shards of a new index (default server default)")
+	replicas := flag.Int("replicas", -1, "number of replicas of a new index (default server default)")
+	indexTemplate := flag.String("template", "", "composable index template string or filename to install before indexing, required to create a -data-stream")
+	indexTemplateName := flag.String("template-name", "", "name of the -template (default -data-stream or -index name)")
+	alias := flag.String("alias", "", "after a successful load, atomically point this alias at the index (with -dir: all indexes loaded) and remove it from other indexes")
+	keepOld := flag.Int("keep-old", -1, "with -alias, keep this many of the indexes, that held the alias before, and delete the rest (default keep all)")
+	forceMerge := flag.Int("forcemerge", 0, "after indexing, force merge each shard down to this many segments (default no force merge)")
+	waitFor := flag.String("wait-for", "", "after indexing, refresh and wait for the index health to become green or yellow")
+	preflight := flag.String("preflight", esbulk.PreflightWarn, "check cluster health, disk space, write queues and index blocks before indexing: off, warn or refuse to start on problems, that would fail the load")
+	postLoadTimeout := flag.Duration("post-load-timeout", time.Hour, "time limit for -forcemerge and -wait-for")
+	action := flag.String("action", "index", "bulk action: index, create (skip existing ids), update, upsert or delete, all but index and create require -id")
+	bulkInput := flag.Bool("bulk-input", false, "input is in elasticsearch bulk format (action and source lines), sent as is")
 	user := flag.String("u", "", "http basic auth username:password, like curl -u")
 	zeroReplica := flag.Bool("0", false, "set the number of replicas to 0 during indexing")
 	maxRetries := flag.Int("retries", 3, "maximum number of retries (default 3) for HTTP requests")
+	compress := flag.Bool("compress", false, "gzip compress bulk requests")
+	compressLevel := flag.Int("compress-level", 0, "gzip level from 1 (fastest) to 9 (smallest), 0 means the gzip default")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "idle connections kept open per server (default number of workers)")
+	requestTimeout := flag.Duration("timeout", 0, "timeout for a single HTTP request, including the response (default no timeout)")
+	dialTimeout := flag.Duration("dial-timeout", 30*time.Second, "timeout for establishing a connection")
+	tlsTimeout := flag.Duration("tls-timeout", 10*time.Second, "timeout for the TLS handshake")
+	bulkRetries := flag.Int("bulk-retries", 8, "number of times documents rejected by a busy cluster are sent again")
+	bulkRetryBackoff := flag.Duration("bulk-retry-backoff", 1*time.Second, "initial wait before rejected documents are sent again, doubles with every retry")
+	deadLetter := flag.String("dead-letter", "", "write documents that cannot be indexed to this file (and error details to file.errors) and continue")
+	checkpoint := flag.String("checkpoint", "", "periodically record the position up to which all documents are indexed in this file")
+	checkpointInterval := flag.Duration("checkpoint-interval", 10*time.Second, "how often to write the checkpoint file")
+	resume := flag.Bool("resume", false, "continue after the position recorded in the -checkpoint file")
 	sourceDir := flag.String("dir", "", "path to directory with source JSON documents")
 	deleteProcessed := flag.Bool("nokeep", false, "delete file from source directory after is processed (default is false)")
 
@@ -79,24 +138,133 @@ func main() {
 	}
 
 	defaultOptions := esbulk.Options{
-		Servers:     serverFlags,
-		Index:       *indexName,
-		Purge:       *purge,
-		Mapping:     *mapping,
-		NumWorkers:  *numWorkers,
-		ZeroReplica: *zeroReplica,
-		GZipped:     *gzipped,
-		DocType:     *docType,
-		BatchSize:   *batchSize,
-		Verbose:     *verbose,
-		Scheme:      "http",
-		IDField:     *idfield,
-		Username:    username,
-		Password:    password,
-		MaxRetries:  *maxRetries,
-	}
-
-	counter := 0
+		Servers:             serverFlags,
+		Index:               *indexName,
+		Purge:               *purge,
+		Mapping:             *mapping,
+		NumWorkers:          *numWorkers,
+		ZeroReplica:         *zeroReplica,
+		GZipped:             *gzipped,
+		DocType:             *docType,
+		BatchSize:           *batchSize,
+		BatchBytes:          int(batchBytes),
+		DropOversized:       *dropOversized,
+		Verbose:             *verbose,
+		Scheme:              "http",
+		IDField:             *idfield,
+		IDSeparator:         *idSeparator,
+		IDTemplate:          *idTemplate,
+		IDHash:              *idHash,
+		IDMissing:           *idMissing,
+		IDNonScalar:         *idNonScalar,
+		RoutingField:        *routingField,
+		VersionField:        *versionField,
+		VersionType:         *versionType,
+		IfSeqNoField:        *ifSeqNoField,
+		IfPrimaryTermField:  *ifPrimaryTermField,
+		ConflictsOK:         *conflictsOK,
+		Pipeline:            *pipeline,
+		PipelineField:       *pipelineField,
+		PipelineDefinition:  *pipelineDefinition,
+		Alias:               *alias,
+		Settings:            *settings,
+		BulkSettings:        *bulkSettings,
+		Shards:              *shards,
+		IndexTemplate:       *indexTemplate,
+		IndexTemplateName:   *indexTemplateName,
+		DataStream:          *dataStream,
+		ForceMerge:          *forceMerge,
+		WaitFor:             *waitFor,
+		PostLoadTimeout:     *postLoadTimeout,
+		Action:              *action,
+		BulkInput:           *bulkInput,
+		Username:            username,
+		Password:            password,
+		MaxRetries:          *maxRetries,
+		MaxIdleConnsPerHost: *maxIdleConns,
+		RequestTimeout:      *requestTimeout,
+		DialTimeout:         *dialTimeout,
+		TLSHandshakeTimeout: *tlsTimeout,
+		BulkRetries:         *bulkRetries,
+		BulkRetryBackoff:    *bulkRetryBackoff,
+		Adaptive:            *adaptive,
+		Preflight:           *preflight,
+		Compress:            *compress,
+		CompressLevel:       *compressLevel,
+	}
+
+	if *replicas >= 0 {
+		defaultOptions.Replicas = replicas
+	}
+	if *keepOld >= 0 {
+		defaultOptions.KeepOld = keepOld
+	}
+
+	// Documents per backing index, reported at the end, which shows rollovers.
+	if *dataStream != "" {
+		defaultOptions.IndexCounts = &esbulk.IndexCounts{}
+	}
+
+	if *deadLetter != "" {
+		df, err := os.Create(*deadLetter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer df.Close()
+		ef, err := os.Create(*deadLetter + ".errors")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ef.Close()
+		defaultOptions.DeadLetter = esbulk.NewDeadLetterWriter(df, ef)
+	}
+
+	if *maxDocsPerSec > 0 || maxBytesPerSec > 0 || *control != "" {
+		defaultOptions.RateLimit = esbulk.NewRateLimiter(*maxDocsPerSec, float64(maxBytesPerSec))
+	}
+	if *control != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*control, controlHandler(defaultOptions.RateLimit)))
+		}()
+	}
+
+	// The first SIGINT or SIGTERM stops reading input, documents already
+	// queued are still indexed and index settings are restored. A second
+	// signal exits immediately.
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("received %s, finishing queued documents, repeat to exit immediately", sig)
+		close(stop)
+		sig = <-sigs
+		log.Printf("received %s, exiting", sig)
+		os.Exit(exitAborted)
+	}()
+	defaultOptions.Stop = stop
+
+	if *resume && *checkpoint == "" {
+		log.Fatal("-resume requires -checkpoint")
+	}
+
+	// newCheckpointer returns a checkpointer for an input file, or nil if
+	// checkpoints are not requested.
+	newCheckpointer := func(filename string) *esbulk.Checkpointer {
+		if *checkpoint == "" {
+			return nil
+		}
+		cp := esbulk.NewCheckpointer(*checkpoint, filename, *checkpointInterval)
+		if *resume {
+			if err := cp.Resume(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return cp
+	}
+
+	var total esbulk.Result
+	interrupted := false
 	start := time.Now()
 	var reader io.Reader
 
@@ -107,6 +275,16 @@ func main() {
 			log.Fatalf("failed to list directory due to %s", err)
 		}
 
+		// Indexes are finished and the alias is swapped once, after all
+		// files are loaded. The alias is only swapped, if all files were
+		// loaded completely.
+		var loaded []string
+		seen := make(map[string]bool)
+		complete := true
+
+		// The cluster is checked before the first file only.
+		defaultOptions.ClusterChecks = &esbulk.ClusterChecks{}
+
 		for _, file := range files {
 			if file.IsDir() {
 				continue
@@ -129,14 +307,28 @@ func main() {
 				continue
 			}
 			reader = f
+			options.Checkpoint = newCheckpointer(path)
+			options.Alias = ""
+			options.ForceMerge, options.WaitFor = 0, ""
 
-			count, err := esbulk.CreateIndexFromLDJFile(reader, options)
+			result, err := esbulk.CreateIndexFromLDJFileContext(context.Background(), reader, options)
+			total = total.Add(result)
+			if err == esbulk.ErrInterrupted {
+				interrupted = true
+				break
+			}
 			if err != nil {
 				log.Print(err)
+				complete = false
 				continue
 			}
-
-			counter += count
+			if result.Failed > 0 {
+				complete = false
+			}
+			if !seen[options.Index] {
+				seen[options.Index] = true
+				loaded = append(loaded, options.Index)
+			}
 
 			if *deleteProcessed {
 				if err := os.Remove(path); err != nil {
@@ -149,6 +341,24 @@ func main() {
 				log.Printf("finished file %q...", file.Name())
 			}
 		}
+
+		if !interrupted {
+			for _, index := range loaded {
+				options := defaultOptions
+				options.Index = index
+				if err := esbulk.FinishIndex(context.Background(), options); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		if *alias != "" && !interrupted && len(loaded) > 0 {
+			if !complete {
+				log.Fatalf("alias %s not swapped, since not all files were loaded completely", *alias)
+			}
+			if err := esbulk.SwapAlias(defaultOptions, *alias, loaded, *keepOld); err != nil {
+				log.Fatal(err)
+			}
+		}
 	} else {
 		// process single file or STDIN
 		reader = os.Stdin
@@ -163,13 +373,21 @@ func main() {
 			reader = f
 		}
 
-		count, err := esbulk.CreateIndexFromLDJFile(reader, defaultOptions)
-		if err != nil {
+		if filename == "" {
+			defaultOptions.Checkpoint = newCheckpointer("-")
+		} else {
+			defaultOptions.Checkpoint = newCheckpointer(filename)
+		}
+
+		result, err := esbulk.CreateIndexFromLDJFileContext(context.Background(), reader, defaultOptions)
+		total = total.Add(result)
+		if err == esbulk.ErrInterrupted {
+			interrupted = true
+		} else if err != nil {
 			log.Fatal(err)
 		}
-		count += counter
 
-		if *deleteProcessed && filename != "" {
+		if *deleteProcessed && filename != "" && !interrupted {
 			if err := os.Remove(filename); err != nil {
 				log.Fatal(err)
 			}
@@ -178,6 +396,12 @@ func main() {
 
 	elapsed := time.Since(start)
 
+	if defaultOptions.DeadLetter != nil {
+		if n := defaultOptions.DeadLetter.Count(); n > 0 {
+			log.Printf("%d documents could not be indexed, see %s", n, *deadLetter)
+		}
+	}
+
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
 		if err != nil {
@@ -188,7 +412,16 @@ func main() {
 	}
 
 	if *verbose {
-		rate := float64(counter) / elapsed.Seconds()
-		log.Printf("%d docs in %s at %0.3f docs/s with %d workers\n", counter, elapsed, rate, *numWorkers)
+		rate := float64(total.Read) / elapsed.Seconds()
+		log.Printf("%d docs in %s at %0.3f docs/s with %d workers (%d indexed, %d failed, %d version conflicts)\n",
+			total.Read, elapsed, rate, *numWorkers, total.Indexed, total.Failed, total.Conflicts)
+	}
+	if defaultOptions.IndexCounts != nil {
+		esbulk.LogIndexCounts(defaultOptions.IndexCounts.Get())
+	}
+
+	if interrupted {
+		log.Printf("interrupted after %d docs", total.Read)
+		os.Exit(exitInterrupted)
 	}
 }
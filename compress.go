@@ -0,0 +1,65 @@
+package esbulk
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// gzipWriters keeps writers for reuse, one pool per compression level, since
+// every new writer allocates several hundred kilobytes.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// compressLevel returns the gzip level to use, zero means the default level.
+func compressLevel(options Options) (int, error) {
+	level := options.CompressLevel
+	if level == 0 {
+		return gzip.DefaultCompression, nil
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid compression level %d, must be between %d and %d",
+			level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	return level, nil
+}
+
+// writeBulkBody writes the lines of a bulk request, gzip compressed if
+// requested.
+func writeBulkBody(w io.Writer, actions []bulkAction, options Options) error {
+	if !options.Compress {
+		return writeBulkLines(w, actions)
+	}
+	level, err := compressLevel(options)
+	if err != nil {
+		return err
+	}
+	pool := &gzipWriters[level-gzip.HuffmanOnly]
+	zw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(w)
+	} else if zw, err = gzip.NewWriterLevel(w, level); err != nil {
+		return err
+	}
+	defer pool.Put(zw)
+	if err := writeBulkLines(zw, actions); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeBulkLines writes header and source lines, each terminated by a newline.
+func writeBulkLines(w io.Writer, actions []bulkAction) error {
+	for _, a := range actions {
+		if _, err := io.WriteString(w, a.header+"\n"); err != nil {
+			return err
+		}
+		if a.source == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, a.source+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
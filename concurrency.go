@@ -0,0 +1,135 @@
+package esbulk
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyTolerance is how much slower than the best observed time per
+	// document a request may be, before it counts as back-pressure.
+	latencyTolerance = 2.0
+	// decreaseCooldown keeps a burst of bad responses to requests, that were
+	// all in flight at the same time, from shrinking the limit repeatedly.
+	decreaseCooldown = time.Second
+	// baselineDecay is how fast the baseline follows a time per document,
+	// that is above it, so a few cheap requests early on do not make all
+	// later ones look slow.
+	baselineDecay = 0.02
+)
+
+// adaptiveLimiter limits the number of bulk requests in flight. The limit
+// starts at one and doubles with every round of healthy requests, until the
+// first sign of back-pressure. From then on, it grows by one per round and is
+// halved on back-pressure (AIMD). Back-pressure is a rejected document, a
+// failed request or a time per document, that is well above the baseline: the
+// best seen, slowly drifting up, if requests stay slower.
+type adaptiveLimiter struct {
+	mu        sync.Mutex
+	changed   chan struct{} // Closed and replaced, whenever a request completes.
+	limit     float64
+	max       int
+	inflight  int
+	slowStart bool
+	latency   float64 // Moving average of the time per document, in ms.
+	baseline  float64 // Lowest moving average seen, decaying upwards.
+	decreased time.Time
+	verbose   bool
+}
+
+func newAdaptiveLimiter(max int, verbose bool) *adaptiveLimiter {
+	return &adaptiveLimiter{
+		changed:   make(chan struct{}),
+		limit:     1,
+		max:       max,
+		slowStart: true,
+		verbose:   verbose,
+	}
+}
+
+// Limit returns the current number of requests allowed in flight.
+func (l *adaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// acquire blocks until another request may be sent.
+func (l *adaptiveLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release records the outcome of a request, adjusts the limit and wakes up
+// waiting requests. A request with a failure, rejected documents or without
+// any documents does not contribute to the latency.
+func (l *adaptiveLimiter) release(failed bool, rejected int, took time.Duration, docs int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	defer func() {
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}()
+
+	slow := false
+	if !failed && rejected == 0 && docs > 0 {
+		perDoc := float64(took) / float64(time.Millisecond) / float64(docs)
+		if l.latency == 0 {
+			l.latency = perDoc
+		} else {
+			l.latency = 0.8*l.latency + 0.2*perDoc
+		}
+		if l.baseline == 0 || l.latency < l.baseline {
+			l.baseline = l.latency
+		} else {
+			l.baseline += baselineDecay * (l.latency - l.baseline)
+		}
+		slow = l.latency > latencyTolerance*l.baseline
+	}
+
+	if failed || rejected > 0 || slow {
+		if time.Since(l.decreased) < decreaseCooldown {
+			return
+		}
+		l.slowStart = false
+		l.decreased = time.Now()
+		l.limit = l.limit / 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		if l.verbose {
+			log.Printf("back-pressure (failed: %v, rejected: %d, slow: %v), allowing %d requests in flight",
+				failed, rejected, slow, int(l.limit))
+		}
+		return
+	}
+
+	previous := int(l.limit)
+	if l.slowStart {
+		l.limit++
+	} else {
+		l.limit += 1 / l.limit
+	}
+	if l.limit > float64(l.max) {
+		l.limit = float64(l.max)
+	}
+	if l.verbose && int(l.limit) != previous {
+		log.Printf("allowing %d requests in flight", int(l.limit))
+	}
+}
@@ -0,0 +1,113 @@
+package esbulk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(8, false)
+	ctx := context.Background()
+
+	// Slow start, one more request in flight per healthy response.
+	for i := 0; i < 4; i++ {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		l.release(false, 0, 10*time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 5 {
+		t.Fatalf("limit after slow start: got %d, want 5", got)
+	}
+
+	// Rejected documents halve the limit.
+	l.acquire(ctx)
+	l.release(false, 3, 10*time.Millisecond, 10)
+	if got := l.Limit(); got != 2 {
+		t.Fatalf("limit after rejection: got %d, want 2", got)
+	}
+
+	// Within the cooldown, further back-pressure is ignored.
+	l.acquire(ctx)
+	l.release(true, 0, 0, 0)
+	if got := l.Limit(); got != 2 {
+		t.Fatalf("limit within cooldown: got %d, want 2", got)
+	}
+
+	// Additive increase, about one per round of requests.
+	for i := 0; i < 2; i++ {
+		l.acquire(ctx)
+		l.release(false, 0, 10*time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 3 {
+		t.Fatalf("limit after additive increase: got %d, want 3", got)
+	}
+
+	// Never more than the maximum.
+	for i := 0; i < 100; i++ {
+		l.acquire(ctx)
+		l.release(false, 0, 10*time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 8 {
+		t.Fatalf("limit: got %d, want 8", got)
+	}
+
+	// Slow responses halve the limit as well.
+	l.decreased = time.Time{}
+	for i := 0; i < 10 && l.Limit() == 8; i++ {
+		l.acquire(ctx)
+		l.release(false, 0, 100*time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 4 {
+		t.Fatalf("limit after slow responses: got %d, want 4", got)
+	}
+}
+
+func TestAdaptiveLimiterBaseline(t *testing.T) {
+	l := newAdaptiveLimiter(8, false)
+	ctx := context.Background()
+
+	// A few cheap requests, then the time per document rises and levels off.
+	for i := 0; i < 5; i++ {
+		l.acquire(ctx)
+		l.release(false, 0, 10*time.Millisecond, 10)
+	}
+	for i := 0; i < 200; i++ {
+		l.decreased = time.Time{}
+		l.acquire(ctx)
+		l.release(false, 0, 50*time.Millisecond, 10)
+	}
+	// Once the baseline caught up, the limit grows again.
+	for i := 0; i < 100; i++ {
+		l.acquire(ctx)
+		l.release(false, 0, 50*time.Millisecond, 10)
+	}
+	if got := l.Limit(); got != 8 {
+		t.Fatalf("limit after latency leveled off: got %d, want 8", got)
+	}
+}
+
+func TestAdaptiveLimiterBlocks(t *testing.T) {
+	l := newAdaptiveLimiter(4, false)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.acquire(context.Background()) }()
+	l.release(false, 0, time.Millisecond, 1)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire not woken up by release")
+	}
+}
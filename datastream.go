@@ -0,0 +1,149 @@
+package esbulk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// checkDataStream returns an error, if options, that only apply to indexes,
+// are combined with a data stream. Data streams only accept create actions.
+func checkDataStream(options Options) error {
+	if options.DataStream == "" {
+		return nil
+	}
+	switch {
+	case options.Index != "":
+		return fmt.Errorf("use either an index or a data stream, not both")
+	case options.BulkInput:
+		return fmt.Errorf("bulk input cannot be used with a data stream")
+	case options.Action != "" && options.Action != ActionCreate:
+		return fmt.Errorf("data streams only support the create action, not %s", options.Action)
+	case options.Purge || options.Mapping != "" || options.Settings != "" || options.Shards > 0 ||
+		options.Replicas != nil || options.ZeroReplica || options.Alias != "":
+		return fmt.Errorf("purge, mapping, settings, shard, replica and alias options do not apply to data streams")
+	}
+	return nil
+}
+
+// DataStreamExists reports whether a data stream exists.
+func DataStreamExists(options Options, name string) (bool, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_data_stream/%s", server, url.PathEscape(name))
+
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not check data stream %s: %s", name, resp.Status)
+	}
+}
+
+// CreateDataStream creates a data stream, which requires a matching index
+// template with a data_stream section.
+func CreateDataStream(options Options, name string) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_data_stream/%s", server, url.PathEscape(name))
+
+	req, err := MakeHTTPRequest(options, "PUT", link, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to create data stream %s with %s: %s", name, resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("created data stream %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// prepareDataStream makes sure the data stream exists, creating it if there
+// is an index template for it. Data streams manage the settings of their
+// backing indexes, so none are changed for the load.
+func prepareDataStream(options Options) error {
+	if options.ServerVersion.Distribution == DistributionElasticsearch && !options.ServerVersion.AtLeast(7, 9) {
+		return fmt.Errorf("data streams require elasticsearch 7.9 or later, found %s", options.ServerVersion)
+	}
+	exists, err := DataStreamExists(options, options.DataStream)
+	if err != nil || exists {
+		return err
+	}
+	if options.IndexTemplate == "" {
+		return fmt.Errorf("data stream %s does not exist, an index template is required to create it", options.DataStream)
+	}
+	return CreateDataStream(options, options.DataStream)
+}
+
+// IndexCounts counts the documents indexed per index, as reported by the
+// server. For data streams, these are the backing indexes, which change on
+// rollover. The zero value is ready to use.
+type IndexCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *IndexCounts) add(index string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[index]++
+}
+
+// Get returns a copy of the counts.
+func (c *IndexCounts) Get() map[string]int {
+	counts := make(map[string]int)
+	if c == nil {
+		return counts
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for index, n := range c.counts {
+		counts[index] = n
+	}
+	return counts
+}
+
+// LogIndexCounts logs the number of documents indexed per index, sorted by
+// index name.
+func LogIndexCounts(counts map[string]int) {
+	var names []string
+	for index := range counts {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	for _, index := range names {
+		log.Printf("%d documents indexed into %s", counts[index], index)
+	}
+}
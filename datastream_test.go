@@ -0,0 +1,118 @@
+package esbulk
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateIndexFromLDJFileDataStream(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.backingIndex = ".ds-logs-000001"
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.Index = ""
+	options.NumWorkers = 1
+	options.BatchSize = 2
+	options.DataStream = "logs"
+	options.IndexCounts = &IndexCounts{}
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "7.8.1", Major: 7, Minor: 8}
+
+	r := strings.NewReader("{\"@timestamp\": 1}\n{\"@timestamp\": 2}\n")
+	if _, err := CreateIndexFromLDJFile(r, options); err == nil || !strings.Contains(err.Error(), "7.9 or later") {
+		t.Fatalf("expected data streams to be refused by elasticsearch 7.8, got %v", err)
+	}
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "7.17.0", Major: 7, Minor: 17}
+	r = strings.NewReader("{\"@timestamp\": 1}\n{\"@timestamp\": 2}\n")
+	if _, err := CreateIndexFromLDJFile(r, options); err != nil {
+		t.Fatal(err)
+	}
+	if counts := options.IndexCounts.Get(); !reflect.DeepEqual(counts, map[string]int{".ds-logs-000001": 2}) {
+		t.Errorf("got counts %v", counts)
+	}
+	bulk := cluster.find("POST /_bulk")
+	if len(bulk) != 1 || !strings.Contains(bulk[0], `{"create": {"_index":"logs"}}`) {
+		t.Fatalf("expected typeless create actions, got %v", cluster.requests)
+	}
+	for _, r := range cluster.requests {
+		if strings.Contains(r, "_settings") || strings.Contains(r, "_flush") {
+			t.Errorf("expected no settings changes for a data stream, got %s", r)
+		}
+	}
+}
+
+func TestCreateIndexFromLDJFileMissingDataStream(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.Index = ""
+	options.NumWorkers = 1
+	options.DataStream = "missing"
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "7.17.0", Major: 7, Minor: 17}
+
+	_, err := CreateIndexFromLDJFile(strings.NewReader("{\"@timestamp\": 1}\n"), options)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing data stream error, got %v", err)
+	}
+
+	options.IndexTemplate = `{"index_patterns": ["missing*"], "data_stream": {}}`
+	if _, err := CreateIndexFromLDJFile(strings.NewReader("{\"@timestamp\": 1}\n"), options); err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster.find(`PUT /_index_template/missing {"index_patterns"`)) != 1 || len(cluster.find("PUT /_data_stream/missing")) != 1 {
+		t.Errorf("expected the template to be installed and the data stream created, got %v", cluster.requests)
+	}
+}
+
+func TestIndexerIndexCounts(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.backingIndex = ".ds-logs-000001"
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.Index = ""
+	options.NumWorkers = 2
+	options.DataStream = "logs"
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "7.17.0", Major: 7, Minor: 17}
+
+	ix, err := NewIndexer(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ix.Add(context.Background(), []byte(`{"@timestamp": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if counts := ix.IndexCounts(); !reflect.DeepEqual(counts, map[string]int{".ds-logs-000001": 3}) {
+		t.Errorf("got counts %v", counts)
+	}
+}
+
+func TestCheckDataStream(t *testing.T) {
+	var cases = []struct {
+		options Options
+		err     bool
+	}{
+		{Options{DataStream: "logs"}, false},
+		{Options{DataStream: "logs", Action: ActionCreate, IDField: "id"}, false},
+		{Options{DataStream: "logs", Index: "logs"}, true},
+		{Options{DataStream: "logs", Action: ActionIndex}, true},
+		{Options{DataStream: "logs", ZeroReplica: true}, true},
+		{Options{DataStream: "logs", BulkInput: true}, true},
+	}
+	for _, c := range cases {
+		if err := checkAction(c.options); (err != nil) != c.err {
+			t.Errorf("%+v: got error %v, want error: %v", c.options, err, c.err)
+		}
+	}
+}
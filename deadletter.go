@@ -0,0 +1,60 @@
+package esbulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DeadLetterWriter records documents, which could not be indexed. Documents
+// are written unchanged, one per line, so the output can be fed back into
+// esbulk. For each document, the error type and reason are written to a
+// separate, optional writer, as JSON with the line number of the document.
+type DeadLetterWriter struct {
+	mu     sync.Mutex
+	docs   io.Writer
+	errors io.Writer
+	count  int
+}
+
+// deadLetterRecord describes, why a document ended up as dead letter.
+type deadLetterRecord struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// NewDeadLetterWriter writes failed documents to docs and the error details
+// to errors, which may be nil.
+func NewDeadLetterWriter(docs, errors io.Writer) *DeadLetterWriter {
+	return &DeadLetterWriter{docs: docs, errors: errors}
+}
+
+// Write records a failed document. It is safe to call from multiple
+// goroutines.
+func (w *DeadLetterWriter) Write(doc, id string, e ItemError) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := fmt.Fprintln(w.docs, doc); err != nil {
+		return err
+	}
+	w.count++
+	if w.errors == nil {
+		return nil
+	}
+	return json.NewEncoder(w.errors).Encode(deadLetterRecord{
+		Line:   w.count,
+		ID:     id,
+		Type:   e.Type,
+		Reason: e.Reason,
+	})
+}
+
+// Count returns the number of documents written so far.
+func (w *DeadLetterWriter) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count
+}
@@ -2,7 +2,10 @@ package esbulk
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,124 +14,257 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
 // Options represents bulk indexing options.
 type Options struct {
-	Servers     []string
-	Index       string
-	Purge       bool
-	Mapping     string
-	DocType     string
-	NumWorkers  int
-	ZeroReplica bool
-	GZipped     bool
-	BatchSize   int
-	Verbose     bool
-	IDField     string
-	Scheme      string // http or https; deprecated, use: Servers.
-	Username    string
-	Password    string
-	MaxRetries  int
+	Servers            []string
+	Index              string
+	Purge              bool
+	Mapping            string
+	DocType            string
+	NumWorkers         int
+	ZeroReplica        bool
+	GZipped            bool
+	BatchSize          int
+	BatchBytes         int  // If positive, a batch is also sent, when its bulk request reaches this size.
+	DropOversized      bool // Documents larger than BatchBytes fail, instead of being sent alone.
+	Verbose            bool
+	IDField            string
+	IDSeparator        string // Joins the values of multiple ID fields.
+	IDTemplate         string // Alternative to IDField, like "{tenant}:{user.id}".
+	IDHash             string // If set, the ID is hashed: sha1, xxhash or murmur3; without ID fields the whole document is.
+	IDMissing          string // Missing or null ID fields: error (default), empty or auto.
+	IDNonScalar        string // Objects and arrays as ID fields: error (default) or json.
+	RoutingField       string // Field with the routing value.
+	VersionField       string // Field with the document version, see VersionType.
+	VersionType        string // external or external_gte; internal versioning if empty.
+	IfSeqNoField       string // Fields with sequence number and primary term for optimistic concurrency control.
+	IfPrimaryTermField string
+	ConflictsOK        bool          // Count version conflicts, but do not treat them as failures; create actions always skip existing IDs.
+	Pipeline           string        // Ingest pipeline for all documents.
+	PipelineField      string        // Field with the ingest pipeline for a document, overrides Pipeline.
+	PipelineDefinition string        // Pipeline definition or filename, uploaded as Pipeline before indexing.
+	Alias              string        // Pointed at Index after a successful load, see SwapAlias.
+	KeepOld            *int          // After the alias swap, keep this many old indexes, that held the alias, and delete the rest; nil keeps all.
+	ForceMerge         int           // After the load, merge each shard down to this many segments.
+	WaitFor            string        // After the load, wait for this index health: green or yellow.
+	PostLoadTimeout    time.Duration // Limits the force merge and the wait, defaults to an hour.
+	Settings           string        // Index settings or filename, sent with the mapping to create the index.
+	BulkSettings       string        // Index settings or filename, applied during the load besides refresh_interval -1.
+	Shards             int           // Number of primary shards of a new index, zero means the server default.
+	Replicas           *int          // Number of replicas of a new index, nil means the server default.
+	IndexTemplate      string        // Composable index template or filename, installed before indexing.
+	IndexTemplateName  string        // Defaults to the data stream or index name.
+	DataStream         string        // Index into this data stream with create actions, instead of Index.
+	Action             string        // Bulk action: index (default), create, update, upsert or delete.
+	BulkInput          bool          // Input is already in bulk format, action and source lines are sent as is.
+	Scheme             string        // http or https; deprecated, use: Servers.
+	Username           string
+	Password           string
+	MaxRetries         int
+	BulkRetries        int                           // Resend documents rejected by a busy cluster this many times.
+	BulkRetryBackoff   time.Duration                 // Initial wait before resending, doubles with every retry.
+	ServerVersion      Version                       // Detected on startup, if not set.
+	Stop               <-chan struct{}               // If closed, reading input stops, queued documents are still indexed.
+	Checkpoint         *Checkpointer                 // If set, indexing progress is recorded and resumed from here.
+	OnSuccess          func(doc Document)            // Called for each document indexed.
+	OnFailure          func(doc Document, err error) // Called for each document, that failed permanently; indexing continues.
+	DeadLetter         *DeadLetterWriter             // If set, failed documents are recorded here and indexing continues.
+	Adaptive           bool                          // Adjust the number of requests in flight to back-pressure, up to NumWorkers.
+	IndexCounts        *IndexCounts                  // If set, documents indexed per index are counted here, across loads.
+	Preflight          string                        // Check the cluster and the index before indexing: off (default), warn or refuse.
+	ClusterChecks      *ClusterChecks                // If set, the cluster is checked once for all loads sharing it, the index for every load.
+	RateLimit          *RateLimiter                  // If set, limits documents and bytes sent per second, across all workers.
+	Compress           bool                          // Send bulk requests gzip compressed.
+	CompressLevel      int                           // From 1 (fastest) to 9 (smallest), zero means the gzip default.
+
+	// HTTP connections are pooled and shared by all requests with the same
+	// settings. Zero values mean defaults.
+	MaxIdleConnsPerHost int           // Defaults to NumWorkers.
+	RequestTimeout      time.Duration // Per attempt, including reading the response; no timeout by default.
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	limiter *adaptiveLimiter // Shared by the workers of an indexer.
+	indexes *indexSet        // Indexes named by a template, prepared on first use.
 }
 
 const (
 	maxRetriesUntilIndexIsDeleted = 5
+	defaultBulkRetryBackoff       = 1 * time.Second
+	maxBulkRetryBackoff           = 1 * time.Minute
 )
 
+// ErrInterrupted is returned, if indexing was stopped before all input was
+// read, because options.Stop was closed.
+var ErrInterrupted = errors.New("interrupted")
+
+// Result summarizes a bulk load.
+type Result struct {
+	Read      int // Documents read from the input.
+	Indexed   int // Documents indexed successfully.
+	Failed    int // Documents, that failed permanently.
+	Conflicts int // Documents rejected with a version conflict, also counted as failed, unless conflicts are ok or the action is create.
+}
+
+// Add returns the sum of two results.
+func (r Result) Add(other Result) Result {
+	return Result{
+		Read:      r.Read + other.Read,
+		Indexed:   r.Indexed + other.Indexed,
+		Failed:    r.Failed + other.Failed,
+		Conflicts: r.Conflicts + other.Conflicts,
+	}
+}
+
 // CreateIndexFromLDJFile reads input file and creates an index given options using
-// multiple workers
+// multiple workers. It returns the number of documents read.
 func CreateIndexFromLDJFile(r io.Reader, options Options) (int, error) {
-	count := 0
+	result, err := CreateIndexFromLDJFileContext(context.Background(), r, options)
+	return result.Read, err
+}
 
-	if options.Index == "" {
-		return count, errors.New("index name required")
+// CreateIndexFromLDJFileContext reads input and indexes it with multiple
+// workers. If the context is done, requests in flight are cancelled. The first
+// error of any worker stops the others. Index settings changed for the bulk
+// load are restored in any case.
+func CreateIndexFromLDJFileContext(ctx context.Context, r io.Reader, options Options) (result Result, err error) {
+	if options.Index == "" && options.DataStream == "" && !options.BulkInput {
+		return result, errors.New("index name required")
+	}
+
+	if options.Alias != "" && (options.Index == "" || isIndexTemplate(options.Index)) {
+		return result, errors.New("an alias requires a fixed index name")
+	}
+	if hasPostLoad(options) && (options.Index == "" || isIndexTemplate(options.Index)) {
+		return result, errors.New("force merge and waiting for health require a fixed index name")
+	}
+	if err := checkPostLoad(options); err != nil {
+		return result, err
+	}
+
+	if err := checkAction(options); err != nil {
+		return result, err
 	}
 
 	if options.Verbose {
 		log.Println(options)
 	}
 
-	if options.Purge {
-		if err := DeleteIndex(options); err != nil {
-			return count, err
-		}
+	options = detectVersion(options)
 
-		// Wait until index is deleted
-		if err := waitForIndexDeletion(options, 0); err != nil {
-			log.Fatalf("unable to check if index is deleted")
-		}
+	if err := preflight(options); err != nil {
+		return result, err
 	}
 
-	// Create index if not exists.
-	if err := CreateIndex(options); err != nil {
-		return count, err
+	if err := preparePipeline(options); err != nil {
+		return result, err
 	}
 
-	if options.Mapping != "" {
-		var reader io.Reader
-		if _, err := os.Stat(options.Mapping); os.IsNotExist(err) {
-			reader = strings.NewReader(options.Mapping)
-		} else {
-			file, err := os.Open(options.Mapping)
-			if err != nil {
-				return count, err
-			}
-			reader = bufio.NewReader(file)
-		}
-
-		if err := PutMapping(options, reader); err != nil {
-			return count, err
-		}
+	if err := prepareIndexTemplate(options); err != nil {
+		return result, err
 	}
 
-	queue := make(chan string)
-	var wg sync.WaitGroup
-
-	for i := 0; i < options.NumWorkers; i++ {
-		wg.Add(1)
-		go Worker(fmt.Sprintf("worker-%d", i), options, queue, &wg)
+	// The alias is swapped last, after the settings are restored and the
+	// index is flushed, and only if all documents made it into the index.
+	if options.Alias != "" {
+		defer func() {
+			if err != nil {
+				return
+			}
+			if result.Failed > 0 {
+				err = fmt.Errorf("alias %s not swapped, %d documents failed", options.Alias, result.Failed)
+				return
+			}
+			keepOld := -1
+			if options.KeepOld != nil {
+				keepOld = *options.KeepOld
+			}
+			err = SwapAlias(options, options.Alias, []string{options.Index}, keepOld)
+		}()
 	}
 
-	for i := range options.Servers {
-		// Store number_of_replicas settings for restoration later.
-		doc, err := GetSettings(i, options)
-		if err != nil {
-			return count, err
+	// Once the settings are restored, the index is made ready to serve.
+	defer func() {
+		if err == nil {
+			err = FinishIndex(ctx, options)
 		}
-
-		// TODO(miku): Rework this.
-		numberOfReplicas := doc[options.Index].(map[string]interface{})["settings"].(map[string]interface{})["index"].(map[string]interface{})["number_of_replicas"]
-		if options.Verbose {
-			log.Printf("on shutdown, number_of_replicas will be set back to %s", numberOfReplicas)
+	}()
+
+	// With bulk input, the index is optional, since the action lines carry
+	// their own index names. Index names, that depend on the documents, are
+	// only known while indexing.
+	switch {
+	case options.DataStream != "":
+		if err := prepareDataStream(options); err != nil {
+			return result, err
 		}
-
-		// Shutdown procedure. TODO(miku): Handle signals, too.
+	case isIndexTemplate(options.Index):
+		indexes := newIndexSet(options)
+		options.indexes = indexes
 		defer func() {
-			// Realtime search & reset number of replicas.
-			if _, err := updateIndexSettings(fmt.Sprintf(`{"index": {"refresh_interval": "1s", "number_of_replicas": %q}}`, numberOfReplicas), options); err != nil {
-				log.Fatal(err)
+			if rerr := indexes.restore(); rerr != nil && err == nil {
+				err = rerr
 			}
-
-			// Persist documents.
-			if FlushIndex(i, options) != nil {
-				log.Fatal(err)
+		}()
+	case options.Index != "":
+		var restore func() error
+		if restore, err = prepareIndex(options); err != nil {
+			return result, err
+		}
+		defer func() {
+			if rerr := restore(); rerr != nil && err == nil {
+				err = rerr
 			}
 		}()
+	}
 
-		// Realtime search and reset number of replicas (if specified).
-		var indexRequest = `{"index": {"refresh_interval": "-1"}}`
-		if options.ZeroReplica {
-			indexRequest = `{"index": {"refresh_interval": "-1", "number_of_replicas": 0}}`
+	ix, err := NewIndexer(ctx, options)
+	if err != nil {
+		return result, err
+	}
+
+	// Whatever happens while reading, documents already queued are indexed
+	// before returning. A worker error takes precedence over an error, that
+	// it caused while reading.
+	defer func() {
+		if cerr := ix.Close(); cerr != nil {
+			err = cerr
 		}
-		resp, err := updateIndexSettings(indexRequest, options)
-		if err != nil {
-			return count, err
+		result = ix.Stats()
+		if options.Checkpoint != nil {
+			if cerr := options.Checkpoint.Save(); cerr != nil && err == nil {
+				err = cerr
+			}
 		}
-		if resp.StatusCode >= 400 {
-			log.Fatal(resp)
+	}()
+
+	// Stop waiting for a worker to take the next document, when interrupted.
+	addCtx, cancelAdd := context.WithCancel(ctx)
+	defer cancelAdd()
+	go func() {
+		select {
+		case <-options.Stop:
+			cancelAdd()
+		case <-addCtx.Done():
+		}
+	}()
+
+	// Skip input, that has been indexed before. Plain files can seek to the
+	// position, otherwise lines are read and discarded.
+	var offset, lineno, skip int64
+	if options.Checkpoint != nil {
+		start := options.Checkpoint.Start()
+		skip = start.Lines
+		if seeker, ok := r.(io.Seeker); ok && start.Offset > 0 && !options.GZipped {
+			if _, err := seeker.Seek(start.Offset, io.SeekStart); err == nil {
+				offset, lineno, skip = start.Offset, start.Lines, 0
+			}
+		}
+		if options.Verbose && start.Lines > 0 {
+			log.Printf("resuming after line %d", start.Lines)
 		}
 	}
 
@@ -136,31 +272,164 @@ func CreateIndexFromLDJFile(r io.Reader, options Options) (int, error) {
 	if options.GZipped {
 		zreader, err := gzip.NewReader(r)
 		if err != nil {
-			return count, err
+			return result, err
 		}
 		reader = bufio.NewReader(zreader)
 	}
 
-	for {
+	// In bulk input mode, an action line and its source line (if any) are
+	// queued together, so they always end up in the same request.
+	var header string
+	for eof := false; !eof; {
+		select {
+		case <-options.Stop:
+			return result, ErrInterrupted
+		case <-ctx.Done():
+			return result, ctx.Err()
+		default:
+		}
 		line, err := reader.ReadString('\n')
 		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return result, err
+		}
+		if eof && len(line) == 0 {
 			break
 		}
-		if err != nil {
-			return count, err
+		offset += int64(len(line))
+		lineno++
+		if lineno <= skip {
+			continue
 		}
 		line = strings.TrimSpace(line)
 		if len(line) == 0 {
 			continue
 		}
-		queue <- line
-		count++
+		if options.BulkInput {
+			if header == "" {
+				ok, err := hasSourceLine(line)
+				if err != nil {
+					return result, err
+				}
+				if ok {
+					header = line
+					continue
+				}
+			} else {
+				line = header + "\n" + line
+				header = ""
+			}
+		}
+		if err := ix.add(addCtx, Document{Body: line, Line: lineno, Offset: offset}); err != nil {
+			select {
+			case <-options.Stop:
+				return result, ErrInterrupted
+			default:
+				return result, err
+			}
+		}
+	}
+
+	if header != "" {
+		return result, fmt.Errorf("bulk input ends with an action line without source: %s", header)
 	}
 
-	close(queue)
-	wg.Wait()
+	return result, nil
+}
+
+// prepareIndex purges the index, if requested, creates it, puts the mapping
+// and applies the settings for bulk loading. The returned function restores
+// the settings.
+func prepareIndex(options Options) (func() error, error) {
+	if options.Purge {
+		if err := DeleteIndex(options); err != nil {
+			return nil, err
+		}
+
+		// Wait until index is deleted
+		if err := waitForIndexDeletion(options, 0); err != nil {
+			return nil, err
+		}
+	}
 
-	return count, nil
+	// Create index if not exists. A new index gets the mapping right away.
+	created, err := createIndex(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Mapping != "" && !created {
+		b, err := readStringOrFile(options.Mapping)
+		if err != nil {
+			return nil, err
+		}
+		if err := PutMapping(options, bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	return setBulkSettings(options)
+}
+
+// setBulkSettings applies the settings for the load, and returns a function,
+// that restores the original values of all settings it changed.
+func setBulkSettings(options Options) (func() error, error) {
+	settings, err := bulkSettings(options)
+	if err != nil {
+		return nil, err
+	}
+	current, err := getFlatSettings(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the original values for restoration later. A setting, that is
+	// not set, is restored with null, which resets it to the default.
+	original := make(map[string]interface{})
+	for name := range settings {
+		original[name] = current[name]
+	}
+	restoreBody, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	if options.Verbose {
+		log.Printf("on shutdown, settings will be set back to %s", restoreBody)
+	}
+
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyIndexSettings(string(body), options); err != nil {
+		return nil, err
+	}
+
+	restore := func() error {
+		if err := applyIndexSettings(string(restoreBody), options); err != nil {
+			return err
+		}
+		// Persist documents.
+		return FlushIndex(0, options)
+	}
+	return restore, nil
+}
+
+// applyIndexSettings updates index settings and fails on an error response.
+func applyIndexSettings(body string, options Options) error {
+	resp, err := updateIndexSettings(body, options)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to apply settings with %s: %s", resp.Status, buf.String())
+	}
+	return nil
 }
 
 // IndexOptionsFromFilepath parses filename to get index options for an index insertion
@@ -196,7 +465,7 @@ func updateIndexSettings(body string, options Options) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -232,7 +501,7 @@ func indexExists(options Options) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
 		return false, err
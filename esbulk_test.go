@@ -1,6 +1,8 @@
 package esbulk
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -8,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -165,3 +168,224 @@ func createLDJFile(filename string) (string, error) {
 func cleanupLDJFile(path string) error {
 	return os.Remove(path)
 }
+
+func TestCreateIndexFromBulkInput(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/" {
+			rw.Write([]byte(`{"version": {"number": "6.8.0"}}`))
+			return
+		}
+		if req.URL.Path != "/_bulk" {
+			t.Errorf("Expect only bulk requests without an index, got %q", req.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		rw.Write([]byte(`{"errors": false, "items": [{"index": {"status": 201}}, {"delete": {"status": 200}}, {"create": {"status": 201}}]}`))
+	}))
+	defer server.Close()
+
+	input := `{"index": {"_index": "a", "_id": "1"}}
+{"x": 1}
+{"delete": {"_index": "b", "_id": "2"}}
+{"create": {"_index": "c", "_id": "3"}}
+{"x": 3}
+`
+	options := getDefaultOptions([]string{server.URL})
+	options.Index = ""
+	options.BulkInput = true
+	options.NumWorkers = 1
+	options.BatchSize = 10
+
+	count, err := CreateIndexFromLDJFile(strings.NewReader(input), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 actions, found %d", count)
+	}
+	if body != input {
+		t.Errorf("Expected input to be sent as is, got %q", body)
+	}
+}
+
+func TestHasSourceLine(t *testing.T) {
+	var cases = []struct {
+		header string
+		result bool
+		err    bool
+	}{
+		{`{"index": {}}`, true, false},
+		{`{"update": {"_id": "1"}}`, true, false},
+		{`{"delete": {"_id": "1"}}`, false, false},
+		{`{"x": 1}`, false, true},
+		{`{"index": {}, "delete": {}}`, false, true},
+		{`not json`, false, true},
+	}
+	for _, c := range cases {
+		result, err := hasSourceLine(c.header)
+		if result != c.result || (err != nil) != c.err {
+			t.Errorf("hasSourceLine(%q) = %v, %v", c.header, result, err)
+		}
+	}
+}
+
+func TestCreateIndexFromLDJFileInterrupted(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	stop := make(chan struct{})
+	close(stop)
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 1
+	options.Stop = stop
+
+	count, err := CreateIndexFromLDJFile(strings.NewReader("{\"a\": 1}\n{\"a\": 2}\n"), options)
+	if err != ErrInterrupted {
+		t.Fatalf("Expected %v, got %v", ErrInterrupted, err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no documents to be read, got %d", count)
+	}
+	settings := cluster.find("PUT /exampleIndex/_settings")
+	if len(settings) != 2 || !strings.Contains(settings[1], `"index.refresh_interval":"30s"`) {
+		t.Errorf("Expected settings to be restored, got %q", settings)
+	}
+	if len(cluster.find("POST /exampleIndex/_flush")) != 1 {
+		t.Error("Expected index to be flushed")
+	}
+}
+
+func TestCreateIndexFromLDJFileContext(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 2
+	options.BatchSize = 2
+
+	result, err := CreateIndexFromLDJFileContext(context.Background(), strings.NewReader("{\"a\": 1}\n{\"a\": 2}\n{\"a\": 3}\n"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (Result{Read: 3, Indexed: 3}) {
+		t.Errorf("Expected 3 documents read and indexed, got %+v", result)
+	}
+}
+
+func TestCreateIndexFromLDJFileContextWorkerError(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.bulkStatus = http.StatusBadRequest
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 2
+	options.MaxRetries = 1
+
+	input := strings.Repeat("{\"a\": 1}\n", 100)
+	_, err := CreateIndexFromLDJFileContext(context.Background(), strings.NewReader(input), options)
+	if err == nil || !strings.Contains(err.Error(), "bulk failed") {
+		t.Fatalf("Expected bulk error, got %v", err)
+	}
+	settings := cluster.find("PUT /exampleIndex/_settings")
+	if len(settings) != 2 || !strings.Contains(settings[1], `"index.refresh_interval":"30s"`) {
+		t.Errorf("Expected settings to be restored, got %q", settings)
+	}
+}
+
+func TestCreateIndexFromLDJFileContextCancelled(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 1
+
+	_, err := CreateIndexFromLDJFileContext(ctx, strings.NewReader("{\"a\": 1}\n"), options)
+	if err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+	if len(cluster.find("PUT /exampleIndex/_settings")) != 2 {
+		t.Error("Expected settings to be restored")
+	}
+}
+
+// testCluster is a minimal fake elasticsearch, that records the requests it
+// receives. Bulk requests always succeed.
+type testCluster struct {
+	*httptest.Server
+	mu         sync.Mutex
+	requests   []string
+	bulkStatus int // If set, bulk requests fail with this status.
+
+	// If set, documents for a data stream are reported in this backing index.
+	backingIndex string
+}
+
+func newTestCluster() *testCluster {
+	c := &testCluster{}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.handle))
+	return c
+}
+
+func (c *testCluster) handle(rw http.ResponseWriter, req *http.Request) {
+	b, _ := ioutil.ReadAll(req.Body)
+	c.mu.Lock()
+	c.requests = append(c.requests, fmt.Sprintf("%s %s %s", req.Method, req.URL.RequestURI(), b))
+	c.mu.Unlock()
+
+	switch {
+	case req.URL.Path == "/":
+		rw.Write([]byte(`{"version": {"number": "6.8.0"}}`))
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/missing"):
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{}`))
+	case strings.HasSuffix(req.URL.Path, "/_bulk") && c.bulkStatus != 0:
+		rw.WriteHeader(c.bulkStatus)
+		rw.Write([]byte(`{"error": "bulk failed"}`))
+	case strings.HasSuffix(req.URL.Path, "/_bulk"):
+		var items []string
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		for i := 0; i < len(lines); i++ {
+			var header map[string]struct {
+				Index string `json:"_index"`
+			}
+			json.Unmarshal([]byte(lines[i]), &header)
+			for op, meta := range header {
+				if c.backingIndex != "" && op == "create" {
+					meta.Index = c.backingIndex
+				}
+				items = append(items, fmt.Sprintf(`{%q: {"_index": %q, "status": 201}}`, op, meta.Index))
+			}
+			if ok, _ := hasSourceLine(lines[i]); ok {
+				i++
+			}
+		}
+		fmt.Fprintf(rw, `{"took": 1, "errors": false, "items": [%s]}`, strings.Join(items, ","))
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/_settings"):
+		index := strings.Split(req.URL.Path, "/")[1]
+		if req.URL.Query().Get("flat_settings") == "true" {
+			fmt.Fprintf(rw, `{%q: {"settings": {"index.number_of_replicas": "1", "index.refresh_interval": "30s"}}}`, index)
+			return
+		}
+		fmt.Fprintf(rw, `{%q: {"settings": {"index": {"number_of_replicas": "1", "refresh_interval": "30s"}}}}`, index)
+	default:
+		rw.Write([]byte(`{}`))
+	}
+}
+
+// find returns the requests, that start with a given method and path.
+func (c *testCluster) find(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []string
+	for _, r := range c.requests {
+		if strings.HasPrefix(r, prefix) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
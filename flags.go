@@ -1,6 +1,10 @@
 package esbulk
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // ArrayFlags allows to store lists of flag values.
 type ArrayFlags []string
@@ -15,3 +19,45 @@ func (f *ArrayFlags) Set(value string) error {
 	*f = append(*f, value)
 	return nil
 }
+
+// ByteSize is a flag value for a number of bytes, which may carry a unit,
+// like 512, 64KB or 10MB.
+type ByteSize int
+
+var byteUnits = []struct {
+	suffix string
+	factor int
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// String representation.
+func (b *ByteSize) String() string {
+	for _, u := range byteUnits {
+		if *b != 0 && int(*b)%u.factor == 0 {
+			return fmt.Sprintf("%d%s", int(*b)/u.factor, u.suffix)
+		}
+	}
+	return "0"
+}
+
+// Set parses a size.
+func (b *ByteSize) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	factor := 1
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*b = ByteSize(n * factor)
+	return nil
+}
@@ -0,0 +1,36 @@
+package esbulk
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	var cases = []struct {
+		value  string
+		size   ByteSize
+		String string
+	}{
+		{"512", 512, "512B"},
+		{"64KB", 64 << 10, "64KB"},
+		{"10MB", 10 << 20, "10MB"},
+		{"10mb", 10 << 20, "10MB"},
+		{"1 GB", 1 << 30, "1GB"},
+		{"0", 0, "0"},
+	}
+	for _, c := range cases {
+		var b ByteSize
+		if err := b.Set(c.value); err != nil {
+			t.Fatal(err)
+		}
+		if b != c.size {
+			t.Errorf("Set(%q): expected %d, got %d", c.value, c.size, b)
+		}
+		if b.String() != c.String {
+			t.Errorf("String(): expected %q, got %q", c.String, b.String())
+		}
+	}
+	for _, value := range []string{"", "MB", "-1", "10XB"} {
+		var b ByteSize
+		if err := b.Set(value); err == nil {
+			t.Errorf("Set(%q): expected error", value)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package esbulk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/spaolacci/murmur3"
+)
+
+// Hash functions for document IDs.
+const (
+	HashSHA1    = "sha1"
+	HashXXHash  = "xxhash"
+	HashMurmur3 = "murmur3"
+)
+
+// Handling of ID fields, that are missing or null.
+const (
+	IDMissingError = "error" // The document fails (default).
+	IDMissingEmpty = "empty" // The field contributes an empty string.
+	IDMissingAuto  = "auto"  // The document gets an ID generated by the server.
+)
+
+// Handling of ID fields, that are objects or arrays.
+const (
+	IDNonScalarError = "error" // The document fails (default).
+	IDNonScalarJSON  = "json"  // The field contributes its JSON, as written.
+)
+
+// hashSeparator separates field values before hashing, if no separator is
+// given, so that e.g. "1", "23" and "12", "3" do not end up with the same ID.
+const hashSeparator = "\x1f"
+
+// idParts returns the parts an ID is made of, either from the template or
+// from the list of ID fields, joined by the separator.
+func idParts(options Options) ([]templatePart, error) {
+	if options.IDTemplate != "" {
+		return parseTemplate(options.IDTemplate, "id")
+	}
+	// A delimiter separates the fields to be concatenated to the ID.
+	fields := strings.FieldsFunc(options.IDField, func(r rune) bool { return r == ',' || r == ' ' })
+	sep := options.IDSeparator
+	if sep == "" && options.IDHash != "" {
+		sep = hashSeparator
+	}
+	var parts []templatePart
+	for i, f := range fields {
+		if i > 0 && sep != "" {
+			parts = append(parts, templatePart{literal: sep})
+		}
+		parts = append(parts, templatePart{field: f})
+	}
+	return parts, nil
+}
+
+// hasID reports whether documents get an ID from esbulk.
+func hasID(options Options) bool {
+	return options.IDField != "" || options.IDTemplate != "" || options.IDHash != ""
+}
+
+// checkID returns an error, if the ID options are invalid.
+func checkID(options Options) error {
+	if options.IDField != "" && options.IDTemplate != "" {
+		return fmt.Errorf("use either an id field or an id template, not both")
+	}
+	if _, err := idParts(options); err != nil {
+		return err
+	}
+	switch options.IDHash {
+	case "", HashSHA1, HashXXHash, HashMurmur3:
+	default:
+		return fmt.Errorf("unknown id hash: %s", options.IDHash)
+	}
+	switch options.IDMissing {
+	case "", IDMissingError, IDMissingEmpty, IDMissingAuto:
+	default:
+		return fmt.Errorf("unknown handling of missing id fields: %s", options.IDMissing)
+	}
+	switch options.IDNonScalar {
+	case "", IDNonScalarError, IDNonScalarJSON:
+	default:
+		return fmt.Errorf("unknown handling of non-scalar id fields: %s", options.IDNonScalar)
+	}
+	return nil
+}
+
+// hashID returns the hex encoded hash of s.
+func hashID(s, hash string) string {
+	switch hash {
+	case HashSHA1:
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	case HashXXHash:
+		return fmt.Sprintf("%016x", xxhash.Sum64String(s))
+	case HashMurmur3:
+		h1, h2 := murmur3.Sum128([]byte(s))
+		return fmt.Sprintf("%016x%016x", h1, h2)
+	}
+	return s
+}
+
+// scanDocument scans a document once for the ID fields and any extra fields.
+// It returns the ID, the raw values of the extra fields, an empty string for
+// a missing one, and the document without an "_id" field, if that is one of
+// the ID fields. An empty ID leaves it to the server to generate one. Without
+// ID fields, a hash of the whole document is used, if a hash is requested.
+func scanDocument(doc string, options Options, extra []string) (string, []string, string, error) {
+	var parts []templatePart
+	if hasID(options) {
+		var err error
+		if parts, err = idParts(options); err != nil {
+			return "", nil, doc, err
+		}
+	}
+	fields := templateFields(parts)
+	// Remove the IDField if it is accidentally named '_id', since
+	// Field [_id] is a metadata field and cannot be added inside a
+	// document.
+	var members *[]span
+	for _, f := range fields {
+		if f == "_id" {
+			members = new([]span)
+		}
+	}
+	numIDFields := len(fields)
+	fields = append(fields, extra...)
+
+	var values []string
+	if len(fields) > 0 {
+		var err error
+		if values, err = scanFields(doc, fields, members); err != nil {
+			return "", nil, doc, invalidDocumentError{fmt.Errorf("failed to json decode doc: %v", err)}
+		}
+	}
+	if members != nil {
+		doc = removeMember(doc, *members, "_id")
+	}
+	if numIDFields == 0 {
+		if options.IDHash == "" {
+			return "", values, doc, nil
+		}
+		return hashID(doc, options.IDHash), values, doc, nil
+	}
+	id, err := buildID(parts, values[:numIDFields], doc, options)
+	return id, values[numIDFields:], doc, err
+}
+
+// buildID puts the ID together from the parts and the values of the fields.
+func buildID(parts []templatePart, values []string, doc string, options Options) (string, error) {
+	// ID can be any type at this point, try to find a string
+	// representation or bail out.
+	var b strings.Builder
+	i := 0
+	for _, p := range parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		v := values[i]
+		i++
+		if v == "" || v == "null" {
+			switch options.IDMissing {
+			case IDMissingEmpty:
+				continue
+			case IDMissingAuto:
+				return "", nil
+			default:
+				return "", invalidDocumentError{fmt.Errorf("document has no ID field (%s): %s", p.field, doc)}
+			}
+		}
+		if p.layout != "" {
+			s, err := formatTime(v, p.layout)
+			if err != nil {
+				return "", invalidDocumentError{fmt.Errorf("invalid id field (%s): %v", p.field, err)}
+			}
+			b.WriteString(s)
+			continue
+		}
+		s, ok := scalarString(v)
+		if !ok {
+			if options.IDNonScalar != IDNonScalarJSON {
+				return "", invalidDocumentError{fmt.Errorf("cannot convert id value to string (%s)", p.field)}
+			}
+			s = v
+		}
+		b.WriteString(s)
+	}
+	if options.IDHash != "" {
+		return hashID(b.String(), options.IDHash), nil
+	}
+	return b.String(), nil
+}
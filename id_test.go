@@ -0,0 +1,151 @@
+package esbulk
+
+import (
+	"testing"
+)
+
+func TestScanDocumentID(t *testing.T) {
+	var cases = []struct {
+		about   string
+		doc     string
+		options Options
+		id      string
+		source  string
+		err     bool
+	}{
+		{
+			about:   "concatenated fields",
+			doc:     `{"a": 1, "b": "23"}`,
+			options: Options{IDField: "a,b"},
+			id:      "123",
+		},
+		{
+			about:   "separator",
+			doc:     `{"a": 1, "b": "23"}`,
+			options: Options{IDField: "a,b", IDSeparator: "-"},
+			id:      "1-23",
+		},
+		{
+			about:   "template",
+			doc:     `{"tenant": "x", "user": {"id": 7}, "ts": 1542100000}`,
+			options: Options{IDTemplate: "{tenant}:{user.id}:{ts}"},
+			id:      "x:7:1542100000",
+		},
+		{
+			about:   "template with a boolean",
+			doc:     `{"a": true}`,
+			options: Options{IDTemplate: "doc-{a}-v1"},
+			id:      "doc-true-v1",
+		},
+		{
+			about:   "sha1 of fields",
+			doc:     `{"a": "abc"}`,
+			options: Options{IDField: "a", IDHash: HashSHA1},
+			id:      "a9993e364706816aba3e25717850c26c9cd0d89d",
+		},
+		{
+			about:   "xxhash of fields",
+			doc:     `{"a": "abc"}`,
+			options: Options{IDField: "a", IDHash: HashXXHash},
+			id:      "44bc2cf5ad770999",
+		},
+		{
+			about:   "murmur3 of fields",
+			doc:     `{"a": "hello"}`,
+			options: Options{IDField: "a", IDHash: HashMurmur3},
+			id:      "cbd8a7b341bd9b025b1e906a48ae1d19",
+		},
+		{
+			about:   "hashed fields are separated",
+			doc:     `{"a": "a", "b": "bc"}`,
+			options: Options{IDField: "a,b", IDHash: HashSHA1},
+			id:      hashID("a\x1fbc", HashSHA1),
+		},
+		{
+			about:   "hash of whole document",
+			doc:     `{"a": "abc"}`,
+			options: Options{IDHash: HashXXHash},
+			id:      hashID(`{"a": "abc"}`, HashXXHash),
+		},
+		{
+			about:   "missing field",
+			doc:     `{"a": 1}`,
+			options: Options{IDField: "a,b"},
+			err:     true,
+		},
+		{
+			about:   "null field, empty",
+			doc:     `{"a": 1, "b": null}`,
+			options: Options{IDField: "a,b", IDSeparator: ":", IDMissing: IDMissingEmpty},
+			id:      "1:",
+		},
+		{
+			about:   "missing field, auto",
+			doc:     `{"a": 1}`,
+			options: Options{IDField: "a,b", IDMissing: IDMissingAuto},
+			id:      "",
+		},
+		{
+			about:   "non-scalar field",
+			doc:     `{"a": [1, 2]}`,
+			options: Options{IDField: "a"},
+			err:     true,
+		},
+		{
+			about:   "non-scalar field, json",
+			doc:     `{"a": [1, 2]}`,
+			options: Options{IDField: "a", IDNonScalar: IDNonScalarJSON},
+			id:      "[1, 2]",
+		},
+		{
+			about:   "_id field is removed",
+			doc:     `{"_id": "x", "a": 1}`,
+			options: Options{IDField: "_id"},
+			id:      "x",
+			source:  `{"a": 1}`,
+		},
+	}
+	for _, c := range cases {
+		if err := checkID(c.options); err != nil {
+			t.Errorf("%s: %v", c.about, err)
+			continue
+		}
+		id, _, source, err := scanDocument(c.doc, c.options, nil)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.about, err, c.err)
+			continue
+		}
+		if id != c.id {
+			t.Errorf("%s: got id %q, want %q", c.about, id, c.id)
+		}
+		if c.source == "" {
+			c.source = c.doc
+		}
+		if !c.err && source != c.source {
+			t.Errorf("%s: got source %s, want %s", c.about, source, c.source)
+		}
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	var cases = []struct {
+		options Options
+		err     bool
+	}{
+		{Options{}, false},
+		{Options{IDTemplate: "{a}:{b.c}"}, false},
+		{Options{IDField: "a", IDTemplate: "{a}"}, true},
+		{Options{IDTemplate: "{a"}, true},
+		{Options{IDTemplate: "a}"}, true},
+		{Options{IDTemplate: "{}"}, true},
+		{Options{IDHash: "md5"}, true},
+		{Options{IDMissing: "skip"}, true},
+		{Options{IDNonScalar: "string"}, true},
+		{Options{IDField: "a", Action: ActionDelete, IDMissing: IDMissingAuto}, true},
+	}
+	for _, c := range cases {
+		if err := checkAction(c.options); (err != nil) != c.err {
+			t.Errorf("%+v: got error %v, want error: %v", c.options, err, c.err)
+		}
+	}
+}
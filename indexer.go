@@ -0,0 +1,193 @@
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrIndexerClosed is returned when adding documents to a closed indexer.
+var ErrIndexerClosed = errors.New("indexer closed")
+
+// Indexer indexes documents in batches with multiple workers. Documents can be
+// added from multiple goroutines. The first error of any worker stops the
+// indexer and is returned from all later calls.
+type Indexer struct {
+	options Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// Adding documents holds a read lock, flushing and closing replace the
+	// queue and hold a write lock.
+	mu     sync.RWMutex
+	queue  chan Document
+	wg     sync.WaitGroup
+	closed bool
+
+	// Serializes adding, so sequence numbers are queued in order.
+	addMu sync.Mutex
+	seq   int64
+
+	statsMu sync.Mutex
+	stats   Result
+	err     error
+}
+
+// NewIndexer starts the workers of an indexer. Only the indexing related
+// options are used, the index is neither created nor prepared. If the context
+// is done, requests in flight are cancelled and the indexer stops.
+func NewIndexer(ctx context.Context, options Options) (*Indexer, error) {
+	if err := checkAction(options); err != nil {
+		return nil, err
+	}
+	if options.NumWorkers < 1 {
+		return nil, fmt.Errorf("at least one worker required")
+	}
+	if options.BatchSize < 1 {
+		return nil, fmt.Errorf("batch size must be positive")
+	}
+	if options.Compress {
+		if _, err := compressLevel(options); err != nil {
+			return nil, err
+		}
+	}
+	if options.Adaptive {
+		options.limiter = newAdaptiveLimiter(options.NumWorkers, options.Verbose)
+	}
+	if options.IndexCounts == nil {
+		options.IndexCounts = &IndexCounts{}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ix := &Indexer{options: options, ctx: ctx, cancel: cancel}
+	ix.start()
+	return ix, nil
+}
+
+// start creates a new queue and the workers to go with it.
+func (ix *Indexer) start() {
+	queue := make(chan Document)
+	for i := 0; i < ix.options.NumWorkers; i++ {
+		ix.wg.Add(1)
+		go func(id string) {
+			defer ix.wg.Done()
+			if _, err := worker(ix.ctx, id, ix.options, queue, ix.progress); err != nil {
+				ix.fail(err)
+			}
+		}(fmt.Sprintf("worker-%d", i))
+	}
+	ix.queue = queue
+}
+
+// drain closes the queue and waits for the workers to index what is left.
+func (ix *Indexer) drain() {
+	if ix.queue == nil {
+		return
+	}
+	close(ix.queue)
+	ix.wg.Wait()
+	ix.queue = nil
+}
+
+func (ix *Indexer) progress(r Result) {
+	ix.statsMu.Lock()
+	defer ix.statsMu.Unlock()
+	ix.stats = ix.stats.Add(r)
+}
+
+// fail records the first error and stops all workers.
+func (ix *Indexer) fail(err error) {
+	ix.statsMu.Lock()
+	defer ix.statsMu.Unlock()
+	if ix.err == nil {
+		ix.err = err
+		ix.cancel()
+	}
+}
+
+// Err returns the error, that stopped the indexer, if any.
+func (ix *Indexer) Err() error {
+	ix.statsMu.Lock()
+	defer ix.statsMu.Unlock()
+	return ix.err
+}
+
+// Add queues a document for indexing. It blocks until a worker takes the
+// document or the context is done.
+func (ix *Indexer) Add(ctx context.Context, doc []byte) error {
+	return ix.add(ctx, Document{Body: string(doc)})
+}
+
+// add queues a document and assigns it the next sequence number.
+func (ix *Indexer) add(ctx context.Context, doc Document) error {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if ix.closed {
+		return ErrIndexerClosed
+	}
+	// After a failed flush, there is no queue to add to.
+	if err := ix.Err(); err != nil {
+		return err
+	}
+	ix.addMu.Lock()
+	defer ix.addMu.Unlock()
+	doc.Seq = ix.seq
+	select {
+	case ix.queue <- doc:
+		ix.seq++
+		ix.statsMu.Lock()
+		ix.stats.Read++
+		ix.statsMu.Unlock()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ix.ctx.Done():
+		if err := ix.Err(); err != nil {
+			return err
+		}
+		return ix.ctx.Err()
+	}
+}
+
+// Flush blocks until all documents added so far have been indexed.
+func (ix *Indexer) Flush() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.closed {
+		return ix.Err()
+	}
+	ix.drain()
+	if err := ix.Err(); err != nil {
+		return err
+	}
+	ix.start()
+	return nil
+}
+
+// Close indexes all documents added so far and stops the workers.
+func (ix *Indexer) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.closed {
+		return ix.Err()
+	}
+	ix.closed = true
+	ix.drain()
+	ix.cancel()
+	return ix.Err()
+}
+
+// Stats returns the number of documents added (as Read), indexed and failed
+// so far.
+func (ix *Indexer) Stats() Result {
+	ix.statsMu.Lock()
+	defer ix.statsMu.Unlock()
+	return ix.stats
+}
+
+// IndexCounts returns the number of documents indexed so far per index, as
+// reported by the server. For a data stream, these are its backing indexes.
+// With options.IndexCounts, documents of earlier loads are included.
+func (ix *Indexer) IndexCounts() map[string]int {
+	return ix.options.IndexCounts.Get()
+}
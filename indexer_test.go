@@ -0,0 +1,264 @@
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIndexer(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	var mu sync.Mutex
+	var succeeded []string
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 2
+	options.BatchSize = 3
+	options.Verbose = false
+	options.OnSuccess = func(doc Document) {
+		mu.Lock()
+		defer mu.Unlock()
+		succeeded = append(succeeded, doc.Body)
+	}
+
+	ix, err := NewIndexer(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := ix.Add(context.Background(), []byte(fmt.Sprintf(`{"i": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ix.Stats(); stats != (Result{Read: 4, Indexed: 4}) {
+		t.Errorf("Expected 4 documents indexed after flush, got %+v", stats)
+	}
+	if err := ix.Add(context.Background(), []byte(`{"i": 4}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ix.Stats(); stats != (Result{Read: 5, Indexed: 5}) {
+		t.Errorf("Expected 5 documents indexed after close, got %+v", stats)
+	}
+	if len(succeeded) != 5 {
+		t.Errorf("Expected 5 success callbacks, got %d", len(succeeded))
+	}
+	if err := ix.Add(context.Background(), []byte(`{"i": 5}`)); err != ErrIndexerClosed {
+		t.Errorf("Expected %v, got %v", ErrIndexerClosed, err)
+	}
+}
+
+func TestIndexerFailure(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.bulkStatus = 400
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 1
+	options.MaxRetries = 1
+
+	ix, err := NewIndexer(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Add(context.Background(), []byte(`{"i": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Flush(); err == nil {
+		t.Fatal("Expected flush to fail")
+	}
+	if err := ix.Add(context.Background(), []byte(`{"i": 2}`)); err == nil {
+		t.Error("Expected add to fail after the indexer stopped")
+	}
+	if err := ix.Close(); err == nil {
+		t.Error("Expected close to return the error")
+	}
+}
+
+func TestIndexerBatchBytes(t *testing.T) {
+	small := `{"a": 111}`
+	large := `{"a": "` + strings.Repeat("x", 100) + `"}`
+
+	for _, drop := range []bool{false, true} {
+		cluster := newTestCluster()
+
+		var failed []string
+		options := getDefaultOptions([]string{cluster.URL})
+		options.NumWorkers = 1
+		options.BatchSize = 100
+		// Room for two small documents with their headers, but not three.
+		options.BatchBytes = 2*documentSize(&Document{Body: small}, options) + 10
+		options.DropOversized = drop
+		options.OnFailure = func(doc Document, err error) {
+			failed = append(failed, doc.Body)
+		}
+
+		ix, err := NewIndexer(context.Background(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, doc := range []string{small, small, small, large, small} {
+			if err := ix.Add(context.Background(), []byte(doc)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ix.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cluster.Close()
+
+		// Batches: two small, one small, the large one alone, one small. A
+		// dropped document never reaches the cluster.
+		bulk := cluster.find("POST /_bulk")
+		switch {
+		case !drop && len(bulk) != 4:
+			t.Errorf("Expected 4 bulk requests, got %d: %q", len(bulk), bulk)
+		case drop && (len(bulk) != 3 || len(failed) != 1 || failed[0] != large):
+			t.Errorf("Expected 3 bulk requests and the large document to fail, got %q, %q", bulk, failed)
+		}
+		if stats := ix.Stats(); drop && stats.Failed != 1 {
+			t.Errorf("Expected 1 failed document, got %+v", stats)
+		}
+	}
+}
+
+func TestIndexerBatchBytesHeaders(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.NumWorkers = 1
+	options.BatchSize = 1000
+	options.BatchBytes = 1000
+	options.Verbose = false
+	options.IDField = "id"
+	options.Action = ActionUpsert
+	ix, err := NewIndexer(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Documents of 200 bytes, the headers and the update wrapping add more
+	// than a third.
+	for i := 0; i < 20; i++ {
+		doc := fmt.Sprintf(`{"id": "%03d", "text": %q}`, i, strings.Repeat("x", 176))
+		if err := ix.Add(context.Background(), []byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bulk := cluster.find("POST /_bulk ")
+	if len(bulk) < 2 {
+		t.Fatalf("expected the documents to be split, got %d bulk requests", len(bulk))
+	}
+	for _, r := range bulk {
+		if size := len(strings.TrimPrefix(r, "POST /_bulk ")); size > options.BatchBytes {
+			t.Errorf("bulk request of %d bytes exceeds %d bytes", size, options.BatchBytes)
+		}
+	}
+}
+
+func TestBulkIndexBatchedAction(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.BatchBytes = 1000
+	doc := Document{Body: `{"a": 1}`}
+	documentSize(&doc, options)
+	if doc.action == nil {
+		t.Fatal("expected the action to be kept with the document")
+	}
+	// The action built, when the document was batched, is sent.
+	doc.action.source = `{"a": 2}`
+	if _, err := bulkIndex(context.Background(), []Document{doc}, options); err != nil {
+		t.Fatal(err)
+	}
+	bulk := cluster.find("POST /_bulk")
+	if len(bulk) != 1 || !strings.Contains(bulk[0], `{"a": 2}`) {
+		t.Errorf("expected the batched action to be sent, got %q", bulk)
+	}
+}
+
+func TestIndexerConflicts(t *testing.T) {
+	response := `{"errors": true, "items": [
+		{"index": {"status": 201}},
+		{"index": {"status": 409, "error": {"type": "version_conflict_engine_exception", "reason": "version conflict"}}}
+	]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	for _, ok := range []bool{true, false} {
+		options := getDefaultOptions([]string{ts.URL})
+		options.NumWorkers = 1
+		options.BatchSize = 2
+		options.Verbose = false
+		options.ConflictsOK = ok
+		ix, err := NewIndexer(context.Background(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := ix.Add(context.Background(), []byte(fmt.Sprintf(`{"i": %d}`, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ix.Close()
+		if ok && err != nil {
+			t.Fatalf("expected conflicts to be ok, got %v", err)
+		}
+		if !ok && err == nil {
+			t.Fatal("expected conflicts to fail")
+		}
+		if stats := ix.Stats(); stats.Indexed != 1 || stats.Conflicts != 1 {
+			t.Errorf("conflicts ok %v: expected 1 indexed and 1 conflict, got %+v", ok, stats)
+		}
+	}
+}
+
+func TestIndexerCreateSkipsExisting(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errors": true, "items": [
+			{"create": {"_id": "1", "status": 201}},
+			{"create": {"_id": "2", "status": 409, "error": {"type": "version_conflict_engine_exception", "reason": "document already exists"}}}
+		]}`))
+	}))
+	defer ts.Close()
+
+	options := getDefaultOptions([]string{ts.URL})
+	options.NumWorkers = 1
+	options.BatchSize = 2
+	options.Verbose = false
+	options.Action = ActionCreate
+	options.IDField = "id"
+	var failed int
+	options.OnFailure = func(doc Document, err error) { failed++ }
+	ix, err := NewIndexer(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := ix.Add(context.Background(), []byte(fmt.Sprintf(`{"id": "%d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatalf("expected an existing ID to be skipped, got %v", err)
+	}
+	if stats := ix.Stats(); stats.Indexed != 1 || stats.Conflicts != 1 || stats.Failed != 0 || failed != 0 {
+		t.Errorf("expected 1 indexed and 1 conflict, got %+v and %d failures", stats, failed)
+	}
+}
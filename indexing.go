@@ -2,13 +2,16 @@ package esbulk
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,21 +20,71 @@ import (
 	"github.com/sethgrid/pester"
 )
 
-// Item represents a bulk action.
+// ItemError describes why a single bulk item failed.
+type ItemError struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	IndexUUID string `json:"index_uuid"`
+	Shard     string `json:"shard"`
+	Index     string `json:"index"`
+}
+
+// Error returns error type and reason.
+func (e ItemError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+}
+
+// ItemResult is the outcome of a single bulk action.
+type ItemResult struct {
+	Index  string    `json:"_index"`
+	Type   string    `json:"_type"`
+	ID     string    `json:"_id"`
+	Status int       `json:"status"`
+	Error  ItemError `json:"error"`
+}
+
+// Item represents a bulk action. Only the field matching the action type of
+// the request is set.
 type Item struct {
-	IndexAction struct {
-		Index  string `json:"_index"`
-		Type   string `json:"_type"`
-		ID     string `json:"_id"`
-		Status int    `json:"status"`
-		Error  struct {
-			Type      string `json:"type"`
-			Reason    string `json:"reason"`
-			IndexUUID string `json:"index_uuid"`
-			Shard     string `json:"shard"`
-			Index     string `json:"index"`
-		} `json:"error"`
-	} `json:"index"`
+	IndexAction  ItemResult `json:"index"`
+	CreateAction ItemResult `json:"create"`
+	UpdateAction ItemResult `json:"update"`
+	DeleteAction ItemResult `json:"delete"`
+}
+
+// Result returns the outcome of the action, regardless of its type.
+func (item Item) Result() ItemResult {
+	switch {
+	case item.CreateAction.Status != 0:
+		return item.CreateAction
+	case item.UpdateAction.Status != 0:
+		return item.UpdateAction
+	case item.DeleteAction.Status != 0:
+		return item.DeleteAction
+	default:
+		return item.IndexAction
+	}
+}
+
+// retryable reports whether the item was rejected because the cluster was
+// too busy at the time, so sending it again later may succeed.
+func (item Item) retryable() bool {
+	result := item.Result()
+	switch result.Status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return result.Error.Type == "es_rejected_execution_exception"
+}
+
+// succeeded reports whether the action had the desired effect. Deleting a
+// document, that does not exist, is not considered an error.
+func (item Item) succeeded() bool {
+	result := item.Result()
+	if result.Status < 300 {
+		return true
+	}
+	return item.DeleteAction.Status == http.StatusNotFound && result.Error.Type == ""
 }
 
 // BulkResponse is a response to a bulk request.
@@ -41,204 +94,680 @@ type BulkResponse struct {
 	Items     []Item `json:"items"`
 }
 
-// nestedStr handles the nested JSON values.
-func nestedStr(tokstr []string, docmap map[string]interface{}, currentID string) interface{} {
-	thistok := tokstr[0]
-	tempStr2, ok := docmap[thistok].(map[string]interface{})
-	if !ok {
-		return nil
+// bulkAction is a single action of a bulk request, along with the document
+// it was built from.
+type bulkAction struct {
+	header string
+	source string
+	doc    Document
+	id     string
+	index  string
+}
+
+// size returns the number of bytes the action takes up in a bulk request.
+func (a bulkAction) size() int {
+	n := len(a.header) + 1
+	if a.source != "" {
+		n += len(a.source) + 1
+	}
+	return n
+}
+
+// documentSize returns the number of bytes a document takes up in a bulk
+// request, along with its header. The action is kept with the document, so
+// it is built only once. Invalid documents fail, when the batch is sent,
+// they are counted by their length.
+func documentSize(doc *Document, options Options) int {
+	a, err := newBulkAction(doc.Body, options)
+	if err != nil {
+		return len(doc.Body) + 1
 	}
-	var TokenVal interface{}
-	var ok1 bool
-	TokenVal = tempStr2
-	for count3 := 1; count3 < len(tokstr); count3++ {
-		thistok = tokstr[count3]
-		TokenVal, ok1 = tempStr2[thistok]
-		if !ok1 {
-			return nil
+	doc.action = &a
+	return a.size()
+}
+
+// invalidDocumentError is returned for documents, that cannot be turned into
+// a bulk action at all.
+type invalidDocumentError struct {
+	err error
+}
+
+func (e invalidDocumentError) Error() string {
+	return e.err.Error()
+}
+
+// Supported bulk actions.
+const (
+	ActionIndex  = "index"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionUpsert = "upsert" // Update with doc_as_upsert.
+	ActionDelete = "delete"
+)
+
+// bulkMeta is the metadata part of a bulk action header.
+type bulkMeta struct {
+	Index         string      `json:"_index"`
+	Type          string      `json:"_type,omitempty"`
+	ID            string      `json:"_id,omitempty"`
+	Routing       string      `json:"routing,omitempty"`
+	Version       json.Number `json:"version,omitempty"`
+	VersionType   string      `json:"version_type,omitempty"`
+	IfSeqNo       json.Number `json:"if_seq_no,omitempty"`
+	IfPrimaryTerm json.Number `json:"if_primary_term,omitempty"`
+	Pipeline      string      `json:"pipeline,omitempty"`
+}
+
+// Version types for external versioning.
+const (
+	VersionTypeExternal    = "external"
+	VersionTypeExternalGTE = "external_gte"
+)
+
+// metaFields returns the document fields, that go into the bulk header
+// besides the ID: routing, version, sequence number, primary term and
+// pipeline.
+func metaFields(options Options) []string {
+	var fields []string
+	for _, f := range []string{options.RoutingField, options.VersionField, options.IfSeqNoField,
+		options.IfPrimaryTermField, options.PipelineField} {
+		if f != "" {
+			fields = append(fields, f)
 		}
-		if count3 < len(tokstr)-1 {
-			tempStr2 = TokenVal.(map[string]interface{})
+	}
+	return fields
+}
+
+// checkMeta returns an error, if the options for header fields are invalid.
+func checkMeta(options Options) error {
+	switch options.VersionType {
+	case "":
+	case VersionTypeExternal, VersionTypeExternalGTE:
+		if options.VersionField == "" {
+			return fmt.Errorf("version type %s requires a version field", options.VersionType)
 		}
+	default:
+		return fmt.Errorf("unknown version type: %s", options.VersionType)
+	}
+	if (options.IfSeqNoField == "") != (options.IfPrimaryTermField == "") {
+		return fmt.Errorf("sequence number and primary term fields must be given together")
 	}
-	return TokenVal
+	if options.VersionField != "" && options.IfSeqNoField != "" {
+		return fmt.Errorf("use either a version field or sequence number fields, not both")
+	}
+	return nil
+}
 
+// setMeta fills in routing, version, sequence numbers and pipeline from the
+// raw values of the fields returned by metaFields. Missing fields are left
+// out.
+func setMeta(meta *bulkMeta, fields, values []string, options Options) error {
+	for i, f := range fields {
+		v := values[i]
+		if v == "" || v == "null" {
+			continue
+		}
+		s, ok := scalarString(v)
+		if !ok {
+			return invalidDocumentError{fmt.Errorf("cannot convert %s value to string", f)}
+		}
+		if f == options.RoutingField {
+			meta.Routing = s
+		}
+		if f == options.PipelineField {
+			meta.Pipeline = s
+		}
+		if f != options.VersionField && f != options.IfSeqNoField && f != options.IfPrimaryTermField {
+			continue
+		}
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return invalidDocumentError{fmt.Errorf("%s value must be an integer: %s", f, s)}
+		}
+		switch f {
+		case options.VersionField:
+			meta.Version = json.Number(s)
+			meta.VersionType = options.VersionType
+		case options.IfSeqNoField:
+			meta.IfSeqNo = json.Number(s)
+		case options.IfPrimaryTermField:
+			meta.IfPrimaryTerm = json.Number(s)
+		}
+	}
+	return nil
 }
 
-// BulkIndex takes a set of documents as strings and indexes them into elasticsearch.
+// checkAction returns an error, if the configured bulk action is unknown or
+// cannot work with the given options.
+func checkAction(options Options) error {
+	if err := checkID(options); err != nil {
+		return err
+	}
+	if err := checkMeta(options); err != nil {
+		return err
+	}
+	if err := checkIndex(options); err != nil {
+		return err
+	}
+	if err := checkDataStream(options); err != nil {
+		return err
+	}
+	switch options.Action {
+	case "", ActionIndex, ActionCreate:
+	case ActionUpdate, ActionUpsert, ActionDelete:
+		if !hasID(options) {
+			return fmt.Errorf("action %s requires an id field", options.Action)
+		}
+		if options.IDMissing == IDMissingAuto {
+			return fmt.Errorf("action %s requires an id for every document", options.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action: %s", options.Action)
+	}
+	return nil
+}
+
+// hasSourceLine reports whether a bulk action line is followed by a source
+// line, which is the case for all actions but delete.
+func hasSourceLine(header string) (bool, error) {
+	var action map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(header), &action); err != nil {
+		return false, fmt.Errorf("invalid bulk action line: %v: %s", err, header)
+	}
+	if len(action) != 1 {
+		return false, fmt.Errorf("bulk action line must have exactly one action: %s", header)
+	}
+	for k := range action {
+		switch k {
+		case ActionIndex, ActionCreate, ActionUpdate:
+			return true, nil
+		case ActionDelete:
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("unknown bulk action: %s", header)
+}
+
+// newBulkAction builds the bulk header and source for a document.
+func newBulkAction(doc string, options Options) (bulkAction, error) {
+	var action bulkAction
+
+	// Bulk input is sent as is.
+	if options.BulkInput {
+		parts := strings.SplitN(doc, "\n", 2)
+		action.header = parts[0]
+		if len(parts) == 2 {
+			action.source = parts[1]
+		}
+		return action, nil
+	}
+
+	// If an ID or other header fields are requested, peek into the document
+	// to extract them and use them in the header.
+	meta := bulkMeta{Index: options.Index}
+	if options.DataStream != "" {
+		meta.Index = options.DataStream
+	}
+	parts, err := indexParts(options)
+	if err != nil {
+		return bulkAction{}, err
+	}
+	fields := metaFields(options)
+	numMeta := len(fields)
+	fields = append(fields, templateFields(parts)...)
+	if hasID(options) || len(fields) > 0 {
+		id, values, source, err := scanDocument(doc, options, fields)
+		if err != nil {
+			return bulkAction{}, err
+		}
+		if err := setMeta(&meta, fields[:numMeta], values[:numMeta], options); err != nil {
+			return bulkAction{}, err
+		}
+		if parts != nil {
+			if meta.Index, err = resolveIndex(parts, values[numMeta:]); err != nil {
+				return bulkAction{}, err
+			}
+		}
+		action.id, doc = id, source
+		meta.ID = id
+	}
+	action.index = meta.Index
+	if !options.ServerVersion.Typeless() && options.DataStream == "" {
+		meta.Type = options.DocType
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return bulkAction{}, err
+	}
+	op := options.Action
+	if options.DataStream != "" {
+		op = ActionCreate
+	}
+	switch op {
+	case ActionUpdate:
+		action.header = fmt.Sprintf(`{"update": %s}`, b)
+		action.source = fmt.Sprintf(`{"doc": %s}`, doc)
+	case ActionUpsert:
+		action.header = fmt.Sprintf(`{"update": %s}`, b)
+		action.source = fmt.Sprintf(`{"doc": %s, "doc_as_upsert": true}`, doc)
+	case ActionDelete:
+		// Delete actions have no source line.
+		action.header = fmt.Sprintf(`{"delete": %s}`, b)
+	case ActionCreate:
+		action.header = fmt.Sprintf(`{"create": %s}`, b)
+		action.source = doc
+	default:
+		action.header = fmt.Sprintf(`{"index": %s}`, b)
+		action.source = doc
+	}
+	return action, nil
+}
+
+// BulkIndex takes a set of documents as strings and indexes them into
+// elasticsearch. Documents, that fail permanently, are written to the dead
+// letter writer, if one is configured.
 func BulkIndex(docs []string, options Options) error {
-	if len(docs) == 0 {
-		return nil
+	return BulkIndexContext(context.Background(), docs, options)
+}
+
+// BulkIndexContext is like BulkIndex, but gives up waiting for the cluster,
+// once the context is done.
+func BulkIndexContext(ctx context.Context, docs []string, options Options) error {
+	batch := make([]Document, len(docs))
+	for i, doc := range docs {
+		batch[i] = Document{Body: doc, Seq: int64(i)}
 	}
+	_, err := bulkIndex(ctx, batch, options)
+	return err
+}
 
-	rand.Seed(time.Now().Unix())
-	server := PickServerURI(options.Servers)
-	link := fmt.Sprintf("%s/_bulk", server)
+// continueOnFailure reports whether documents, that fail permanently, are
+// handed off, so indexing can go on.
+func continueOnFailure(options Options) bool {
+	return options.DeadLetter != nil || options.OnFailure != nil
+}
 
-	var lines []string
-	for _, doc := range docs {
-		if len(strings.TrimSpace(doc)) == 0 {
-			continue
+// fail hands off a document, that failed permanently.
+func fail(doc Document, id string, e ItemError, options Options) error {
+	if options.DeadLetter != nil {
+		if err := options.DeadLetter.Write(doc.Body, id, e); err != nil {
+			return err
 		}
+	}
+	if options.OnFailure != nil {
+		options.OnFailure(doc, e)
+	}
+	if options.Verbose {
+		log.Printf("failed document: %s", e)
+	}
+	return nil
+}
 
-		header := fmt.Sprintf(`{"index": {"_index": "%s", "_type": "%s"}}`, options.Index, options.DocType)
+// succeed reports a successfully indexed document.
+func succeed(doc Document, options Options) {
+	if options.OnSuccess != nil {
+		options.OnSuccess(doc)
+	}
+}
 
-		// If an "-id" is given, peek into the document to extract the ID and
-		// use it in the header.
-		if options.IDField != "" {
-			var docmap map[string]interface{}
-			dec := json.NewDecoder(strings.NewReader(doc))
-			dec.UseNumber()
-			if err := dec.Decode(&docmap); err != nil {
-				return fmt.Errorf("failed to json decode doc: %v", err)
-			}
+// bulkIndex indexes documents and returns the number of documents indexed
+// and failed.
+func bulkIndex(ctx context.Context, docs []Document, options Options) (Result, error) {
+	var result Result
+	if len(docs) == 0 {
+		return result, nil
+	}
+	if err := checkAction(options); err != nil {
+		return result, err
+	}
 
-			idstring := options.IDField // A delimiter separates string with all the fields to be used as ID.
-			id := strings.FieldsFunc(idstring, func(r rune) bool { return r == ',' || r == ' ' })
-			// ID can be any type at this point, try to find a string
-			// representation or bail out.
-			var idstr string
-			var currentID string
-			for counter := range id {
-				currentID = id[counter]
-				tokstr := strings.Split(currentID, ".")
-				var TokenVal interface{}
-				if len(tokstr) > 1 {
-					TokenVal = nestedStr(tokstr, docmap, currentID)
-					if TokenVal == nil {
-						return fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
-					}
-				} else {
-					var ok2 bool
-					TokenVal, ok2 = docmap[currentID]
-					if !ok2 {
-						return fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
-					}
-				}
-				switch tempStr1 := interface{}(TokenVal).(type) {
-				case string:
-					idstr = idstr + tempStr1
-				case fmt.Stringer:
-					idstr = idstr + tempStr1.String()
-				case json.Number:
-					idstr = idstr + tempStr1.String()
-				default:
-					return fmt.Errorf("cannot convert id value to string")
-				}
+	var actions []bulkAction
+	for _, doc := range docs {
+		if len(strings.TrimSpace(doc.Body)) == 0 {
+			continue
+		}
+		action, err := doc.bulkAction(options)
+		if ierr, ok := err.(invalidDocumentError); ok && continueOnFailure(options) {
+			if err := fail(doc, "", ItemError{Type: "invalid_document", Reason: ierr.Error()}, options); err != nil {
+				return result, err
 			}
+			result.Failed++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if options.DropOversized && options.BatchBytes > 0 && action.size() > options.BatchBytes {
+			e := ItemError{
+				Type:   "document_too_large",
+				Reason: fmt.Sprintf("document of %d bytes exceeds the batch size limit of %d bytes", action.size(), options.BatchBytes),
+			}
+			if !continueOnFailure(options) {
+				return result, e
+			}
+			if err := fail(doc, action.id, e, options); err != nil {
+				return result, err
+			}
+			result.Failed++
+			continue
+		}
+		doc.action = nil
+		action.doc = doc
+		actions = append(actions, action)
+	}
+	if len(actions) == 0 {
+		return result, nil
+	}
+	if options.indexes != nil {
+		for _, a := range actions {
+			if err := options.indexes.prepare(a.index); err != nil {
+				return result, err
+			}
+		}
+	}
 
-			header = fmt.Sprintf(`{"index": {"_index": "%s", "_type": "%s", "_id": %q}}`,
-				options.Index, options.DocType, idstr)
-
-			// Remove the IDField if it is accidentally named '_id', since
-			// Field [_id] is a metadata field and cannot be added inside a
-			// document.
-			var flag int
-			for count := range id {
-				if id[count] == "_id" {
-					flag = 1 // Check if any of the id fields to be concatenated is named '_id'.
+	// Items, which the cluster rejected because it was too busy, are sent
+	// again with exponential backoff, until the retry budget is used up.
+	backoff := options.BulkRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultBulkRetryBackoff
+	}
+	for retry := 0; ; retry++ {
+		br, err := sendLimited(ctx, actions, options)
+		if err != nil {
+			return result, err
+		}
+		if !br.HasErrors {
+			for _, a := range actions {
+				succeed(a.doc, options)
+			}
+			for _, item := range br.Items {
+				options.IndexCounts.add(item.Result().Index)
+			}
+			result.Indexed += len(actions)
+			return result, nil
+		}
+		if len(br.Items) != len(actions) {
+			return result, fmt.Errorf("bulk response has %d items, but %d were sent", len(br.Items), len(actions))
+		}
+		var rejected []bulkAction
+		var failed []Item
+		for i, item := range br.Items {
+			conflict := item.Result().Status == http.StatusConflict
+			if conflict {
+				result.Conflicts++
+			}
+			switch {
+			case item.succeeded():
+				succeed(actions[i].doc, options)
+				options.IndexCounts.add(item.Result().Index)
+				result.Indexed++
+			case conflict && (options.ConflictsOK || item.CreateAction.Status != 0):
+				// A create action skips documents, whose ID already exists.
+				succeed(actions[i].doc, options)
+			case item.retryable():
+				rejected = append(rejected, actions[i])
+			case continueOnFailure(options):
+				ir := item.Result()
+				if err := fail(actions[i].doc, ir.ID, ir.Error, options); err != nil {
+					return result, err
 				}
+				result.Failed++
+			default:
+				failed = append(failed, item)
 			}
-
-			if flag == 1 {
-				delete(docmap, "_id")
-				b, err := json.Marshal(docmap)
-				if err != nil {
-					return err
+		}
+		if len(failed) > 0 {
+			if options.Verbose {
+				log.Println("Error details: ")
+				for _, v := range failed {
+					log.Printf("  %q\n", v.Result().Error)
 				}
-				doc = string(b)
 			}
+			e := failed[0].Result().Error
+			return result, fmt.Errorf("error during bulk operation, %d documents failed, first error: %s: %s",
+				len(failed), e.Type, e.Reason)
+		}
+		if len(rejected) == 0 {
+			return result, nil
+		}
+		if retry >= options.BulkRetries {
+			return result, fmt.Errorf("error during bulk operation, %d documents still rejected after %d retries, try less workers (lower -w value or use -adaptive) or increase thread_pool.bulk.queue_size in your nodes", len(rejected), retry)
+		}
+		if options.Verbose {
+			log.Printf("%d documents rejected, retrying in %s", len(rejected), backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, ctx.Err()
 		}
-		lines = append(lines, header, doc)
+		if backoff < maxBulkRetryBackoff {
+			backoff *= 2
+		}
+		actions = rejected
 	}
+}
 
-	body := fmt.Sprintf("%s\n", strings.Join(lines, "\n"))
+// sendLimited sends a bulk request, once the rate limiter and the adaptive
+// limiter, if any, allow it, and reports back to the latter how it went.
+func sendLimited(ctx context.Context, actions []bulkAction, options Options) (*BulkResponse, error) {
+	if options.RateLimit != nil {
+		var size int
+		for _, a := range actions {
+			size += a.size()
+		}
+		if err := options.RateLimit.Wait(ctx, len(actions), size); err != nil {
+			return nil, err
+		}
+	}
+	if options.limiter == nil {
+		return sendBulkRequest(ctx, actions, options)
+	}
+	if err := options.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	br, err := sendBulkRequest(ctx, actions, options)
+	if err != nil {
+		options.limiter.release(true, 0, 0, 0)
+		return br, err
+	}
+	var rejected int
+	for _, item := range br.Items {
+		if item.retryable() {
+			rejected++
+		}
+	}
+	options.limiter.release(false, rejected, time.Duration(br.Took)*time.Millisecond, len(actions))
+	return br, nil
+}
+
+// sendBulkRequest sends actions to the bulk API and decodes the response.
+func sendBulkRequest(ctx context.Context, actions []bulkAction, options Options) (*BulkResponse, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_bulk", server)
+	if options.BulkInput && options.Index != "" {
+		// Default index for action lines, that do not name one.
+		link = fmt.Sprintf("%s/%s/_bulk", server, options.Index)
+	}
+	if options.Pipeline != "" {
+		link = fmt.Sprintf("%s?pipeline=%s", link, url.QueryEscape(options.Pipeline))
+	}
+
+	// The body is kept in memory, so the client can send it again on
+	// connection errors.
+	var body bytes.Buffer
+	if err := writeBulkBody(&body, actions, options); err != nil {
+		return nil, err
+	}
 
 	// There are multiple ways indexing can fail, e.g. connection errors or
 	// bad requests. Finally, if we have a HTTP 200, the bulk request could
 	// still have failed: for that we need to decode the elasticsearch
 	// response.
-	req, err := MakeHTTPRequest(options, "POST", link, strings.NewReader(body))
+	req, err := MakeHTTPRequest(options, "POST", link, bytes.NewReader(body.Bytes()))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if options.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	client := httpClient(options)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
-	resp, err := client.Do(req)
 	defer resp.Body.Close()
 
-	if err != nil || resp.StatusCode >= 400 {
-		if options.Verbose {
-			logClientErrors(client.LogString())
-		}
-
+	if resp.StatusCode >= 400 {
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, resp.Body); err != nil {
-			return err
+			return nil, err
 		}
-		return fmt.Errorf("indexing failed with %d %s: %s",
+		return nil, fmt.Errorf("indexing failed with %d %s: %s",
 			resp.StatusCode, http.StatusText(resp.StatusCode), buf.String())
 	}
 
 	var br BulkResponse
 	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
-		return err
+		return nil, err
 	}
-	if br.HasErrors {
-		if options.Verbose {
-			log.Println("Error details: ")
-			for _, v := range br.Items {
-				log.Printf("  %q\n", v.IndexAction.Error)
-			}
-		}
-		return fmt.Errorf("error during bulk operation, check error details, try less workers (lower -w value) or  increase thread_pool.bulk.queue_size in your nodes")
+	// Read what is left, so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	return &br, nil
+}
+
+// Document is a line of input, along with its position. For bulk input, a
+// document consists of an action line and its source line.
+type Document struct {
+	Body   string
+	Seq    int64 // Sequence number among the documents read.
+	Line   int64 // Number of the last line of the document.
+	Offset int64 // Byte offset just past the document.
+
+	action *bulkAction // Built when the document was batched, if at all.
+}
+
+// bulkAction returns the action built for the document, when it was batched,
+// or builds it.
+func (doc Document) bulkAction(options Options) (bulkAction, error) {
+	if doc.action != nil {
+		return *doc.action, nil
 	}
-	return nil
+	return newBulkAction(doc.Body, options)
 }
 
 // Worker will batch index documents that come in on the lines channel.
+//
+// Deprecated: Worker exits the program, if indexing fails. Use WorkerContext,
+// which returns the error, or an Indexer.
 func Worker(id string, options Options, lines chan string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	var docs []string
+	docs := make(chan Document)
+	go func() {
+		defer close(docs)
+		var seq int64
+		for line := range lines {
+			docs <- Document{Body: line, Seq: seq}
+			seq++
+		}
+	}()
+	if _, err := WorkerContext(context.Background(), id, options, docs); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// WorkerContext will batch index documents that come in on the docs channel,
+// until the channel is closed, indexing fails or the context is done. It
+// returns the number of documents indexed and failed.
+func WorkerContext(ctx context.Context, id string, options Options, docs <-chan Document) (Result, error) {
+	return worker(ctx, id, options, docs, nil)
+}
+
+// worker is a WorkerContext, that reports the outcome of each batch to
+// progress, if it is not nil.
+func worker(ctx context.Context, id string, options Options, docs <-chan Document, progress func(Result)) (Result, error) {
+	var result Result
+	var batch []Document
+	var batchBytes int
 	counter := 0
-	for s := range lines {
-		docs = append(docs, s)
-		counter++
-		if counter%options.BatchSize == 0 {
-			msg := make([]string, len(docs))
-			if n := copy(msg, docs); n != len(docs) {
-				log.Fatalf("expected %d, but got %d", len(docs), n)
+	flush := func() error {
+		r, err := indexBatch(ctx, batch, options)
+		result = result.Add(r)
+		if progress != nil {
+			progress(r)
+		}
+		if err != nil {
+			return fmt.Errorf("[%s] %v", id, err)
+		}
+		if options.Verbose {
+			log.Printf("[%s] @%d\n", id, counter)
+		}
+		batch, batchBytes = nil, 0
+		return nil
+	}
+	for {
+		select {
+		case doc, ok := <-docs:
+			if !ok {
+				if len(batch) == 0 {
+					return result, nil
+				}
+				return result, flush()
 			}
-
-			if err := BulkIndex(msg, options); err != nil {
-				log.Fatal(err)
+			counter++
+			// A batch is sent, before a document would push it over the size
+			// limit. A document larger than the limit is sent on its own. The
+			// size includes the header, that goes with each document.
+			size := len(doc.Body) + 1
+			if options.BatchBytes > 0 {
+				size = documentSize(&doc, options)
 			}
-			if options.Verbose {
-				log.Printf("[%s] @%d\n", id, counter)
+			if options.BatchBytes > 0 && len(batch) > 0 && batchBytes+size > options.BatchBytes {
+				if err := flush(); err != nil {
+					return result, err
+				}
+			}
+			batch = append(batch, doc)
+			batchBytes += size
+			if len(batch) >= options.BatchSize || (options.BatchBytes > 0 && batchBytes >= options.BatchBytes) {
+				if err := flush(); err != nil {
+					return result, err
+				}
 			}
-			docs = nil
+		case <-ctx.Done():
+			return result, ctx.Err()
 		}
 	}
-	if len(docs) == 0 {
-		return
-	}
-	msg := make([]string, len(docs))
-	if n := copy(msg, docs); n != len(docs) {
-		log.Fatalf("expected %d, but got %d", len(docs), n)
-	}
+}
 
-	if err := BulkIndex(msg, options); err != nil {
-		log.Fatal(err)
+// indexBatch indexes a batch of documents and records them as done.
+func indexBatch(ctx context.Context, batch []Document, options Options) (Result, error) {
+	result, err := bulkIndex(ctx, batch, options)
+	if err != nil {
+		return result, err
 	}
-	if options.Verbose {
-		log.Printf("[%s] @%d\n", id, counter)
+	if options.Checkpoint != nil {
+		return result, options.Checkpoint.Ack(batch)
 	}
+	return result, nil
 }
 
-// PutMapping applies a mapping from a reader.
+// PutMapping applies a mapping from a reader. Clusters without mapping types
+// get a typeless mapping; a mapping wrapped in the document type, as it was
+// customary before, is unwrapped.
 func PutMapping(options Options, body io.Reader) error {
 	server := PickServerURI(options.Servers)
 	link := fmt.Sprintf("%s/%s/_mapping/%s", server, options.Index, options.DocType)
 
+	if options.ServerVersion.Typeless() {
+		link = fmt.Sprintf("%s/%s/_mapping", server, options.Index)
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(unwrapTypedMapping(b, options.DocType))
+	}
+
 	if options.Verbose {
 		log.Printf("applying mapping: %s", link)
 	}
@@ -246,16 +775,12 @@ func PutMapping(options Options, body io.Reader) error {
 	if err != nil {
 		return err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		if options.Verbose {
-			logClientErrors(client.LogString())
-		}
-
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, resp.Body); err != nil {
 			return err
@@ -268,34 +793,59 @@ func PutMapping(options Options, body io.Reader) error {
 	return resp.Body.Close()
 }
 
-// CreateIndex creates a new index.
+// unwrapTypedMapping turns {"doctype": {"properties": ...}} into
+// {"properties": ...}, other mappings are returned unchanged.
+func unwrapTypedMapping(b []byte, docType string) []byte {
+	var mapping map[string]json.RawMessage
+	if err := json.Unmarshal(b, &mapping); err != nil || len(mapping) != 1 {
+		return b
+	}
+	if inner, ok := mapping[docType]; ok {
+		return inner
+	}
+	return b
+}
+
+// CreateIndex creates a new index, with the settings and the mapping, if
+// given. An existing index is left as it is.
 func CreateIndex(options Options) error {
+	_, err := createIndex(options)
+	return err
+}
+
+// createIndex creates the index, if it does not exist yet, and reports
+// whether it did.
+func createIndex(options Options) (bool, error) {
+	body, err := createIndexBody(options)
+	if err != nil {
+		return false, err
+	}
 	server := PickServerURI(options.Servers)
 	link := fmt.Sprintf("%s/%s", server, options.Index)
 
 	req, err := MakeHTTPRequest(options, "GET", link, nil)
 	if err != nil {
-		return err
+		return false, err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer resp.Body.Close()
 
 	// Index already exists, return.
 	if resp.StatusCode == 200 {
-		return nil
+		return false, nil
 	}
 
-	req, err = MakeHTTPRequest(options, "PUT", fmt.Sprintf("%s/%s/", server, options.Index), nil)
+	req, err = MakeHTTPRequest(options, "PUT", fmt.Sprintf("%s/%s/", server, options.Index), bytes.NewReader(body))
 	if err != nil {
-		return err
+		return false, err
 	}
 	resp, err = client.Do(req)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Elasticsearch backwards compat.
@@ -309,7 +859,7 @@ func CreateIndex(options Options) error {
 		// Might return a 400 on "No handler found for uri" ...
 		if json.NewDecoder(rdr).Decode(&errResponse) == nil {
 			if strings.Contains(errResponse.Error, "IndexAlreadyExistsException") {
-				return nil
+				return false, nil
 			}
 		}
 		log.Printf("es response was: %s", buf.String())
@@ -317,20 +867,16 @@ func CreateIndex(options Options) error {
 
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		if options.Verbose {
-			logClientErrors(client.LogString())
-		}
-
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, resp.Body); err != nil {
-			return err
+			return false, err
 		}
-		return errors.New(buf.String())
+		return false, errors.New(buf.String())
 	}
 	if options.Verbose {
 		log.Printf("created index: %s\n", resp.Status)
 	}
-	return nil
+	return true, nil
 }
 
 // DeleteIndex removes an index.
@@ -342,19 +888,21 @@ func DeleteIndex(options Options) error {
 	if err != nil {
 		return err
 	}
-	client := MakeHTTPClient(options.MaxRetries)
+	client := httpClient(options)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	if options.Verbose {
-		logClientErrors(client.LogString())
 		log.Printf("purged index: %s", resp.Status)
 	}
 	return resp.Body.Close()
 }
 
-// MakeHTTPClient returns HTTP client with exponential backoff logic
+// MakeHTTPClient returns HTTP client with exponential backoff logic.
+//
+// Deprecated: esbulk uses shared clients with pooled connections, configured
+// through Options.
 func MakeHTTPClient(maxRetries int) *pester.Client {
 	client := pester.New()
 	client.Concurrency = 1
@@ -384,42 +932,3 @@ func PickServerURI(servers []string) string {
 	rand.Seed(time.Now().Unix())
 	return servers[rand.Intn(len(servers))]
 }
-
-func logClientErrors(clientLogString string) {
-	if clientLogString != "" {
-		// to make logging format consistent we need to temporary
-		// remove timestamp prefix as it was already collected by
-		// `pester` HTTP client
-		originalLogFlags := log.Flags()
-		log.SetFlags(originalLogFlags &^ (log.Ldate | log.Ltime))
-		lines := strings.Split(clientLogString, "\n")
-		for _, line := range lines {
-			if len(line) > 1 {
-				log.Println(normalizeLogLine(line))
-			}
-		}
-		log.SetFlags(originalLogFlags)
-	}
-}
-
-// As `pester` collects all retry log lines with Unix timestamp format
-// we need to normalize its timestamp format
-func normalizeLogLine(line string) string {
-	parsedTs, err := strconv.ParseInt(line[:10], 10, 64)
-	if err != nil {
-		return line
-	}
-	ts := time.Unix(parsedTs, 0)
-
-	var buf bytes.Buffer
-	_, err = buf.WriteString(ts.Format("2006/01/02 15:04:05"))
-	if err != nil {
-		return line
-	}
-	_, err = buf.WriteString(line[10:])
-	if err != nil {
-		return line
-	}
-
-	return buf.String()
-}
@@ -1,9 +1,16 @@
 package esbulk_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/idagio/esbulk"
 )
@@ -39,3 +46,269 @@ func TestDeleteIndexBackoff(t *testing.T) {
 		t.Errorf("Expected %d, found %d", expectedMaxRetries, currentRetries)
 	}
 }
+
+func TestBulkIndexRetriesRejectedItems(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, string(b))
+		if len(requests) == 1 {
+			rw.Write([]byte(`{"took": 1, "errors": true, "items": [
+				{"index": {"status": 201}},
+				{"index": {"status": 429, "error": {"type": "es_rejected_execution_exception"}}}]}`))
+			return
+		}
+		rw.Write([]byte(`{"took": 1, "errors": false, "items": [{"index": {"status": 201}}]}`))
+	}))
+	defer server.Close()
+
+	options := esbulk.Options{
+		Servers:          []string{server.URL},
+		Index:            "exampleIndex",
+		DocType:          "default",
+		MaxRetries:       1,
+		BulkRetries:      2,
+		BulkRetryBackoff: time.Millisecond,
+	}
+
+	if err := esbulk.BulkIndex([]string{`{"a": 1}`, `{"a": 2}`}, options); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, found %d", len(requests))
+	}
+	if strings.Contains(requests[1], `{"a": 1}`) || !strings.Contains(requests[1], `{"a": 2}`) {
+		t.Errorf("Expected only the rejected document to be resent, got %q", requests[1])
+	}
+}
+
+func TestBulkIndexRetryBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"took": 1, "errors": true, "items": [{"index": {"status": 429}}]}`))
+	}))
+	defer server.Close()
+
+	options := esbulk.Options{
+		Servers:          []string{server.URL},
+		Index:            "exampleIndex",
+		DocType:          "default",
+		MaxRetries:       1,
+		BulkRetries:      2,
+		BulkRetryBackoff: time.Millisecond,
+	}
+
+	if err := esbulk.BulkIndex([]string{`{"a": 1}`}, options); err == nil {
+		t.Error("Expected an error after the retry budget is used up")
+	}
+}
+
+func TestBulkIndexDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"took": 1, "errors": true, "items": [
+			{"index": {"status": 201}},
+			{"index": {"status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse"}}}]}`))
+	}))
+	defer server.Close()
+
+	var docs, errs bytes.Buffer
+	options := esbulk.Options{
+		Servers:    []string{server.URL},
+		Index:      "exampleIndex",
+		DocType:    "default",
+		MaxRetries: 1,
+		DeadLetter: esbulk.NewDeadLetterWriter(&docs, &errs),
+	}
+
+	if err := esbulk.BulkIndex([]string{`{"a": 1}`, `{"a": "x"}`}, options); err != nil {
+		t.Fatal(err)
+	}
+	if docs.String() != "{\"a\": \"x\"}\n" {
+		t.Errorf("Expected the failed document verbatim, got %q", docs.String())
+	}
+	if !strings.Contains(errs.String(), "mapper_parsing_exception") {
+		t.Errorf("Expected error details, got %q", errs.String())
+	}
+	if options.DeadLetter.Count() != 1 {
+		t.Errorf("Expected 1 dead letter, found %d", options.DeadLetter.Count())
+	}
+}
+
+func TestBulkIndexActions(t *testing.T) {
+	var cases = []struct {
+		action   string
+		response string
+		body     string
+	}{
+		{
+			action:   esbulk.ActionCreate,
+			response: `{"errors": false, "items": [{"create": {"status": 201}}]}`,
+			body:     "{\"create\": {\"_index\":\"exampleIndex\",\"_type\":\"default\",\"_id\":\"1\"}}\n{\"id\": \"1\", \"a\": 1}\n",
+		},
+		{
+			action:   esbulk.ActionUpsert,
+			response: `{"errors": false, "items": [{"update": {"status": 200}}]}`,
+			body:     "{\"update\": {\"_index\":\"exampleIndex\",\"_type\":\"default\",\"_id\":\"1\"}}\n{\"doc\": {\"id\": \"1\", \"a\": 1}, \"doc_as_upsert\": true}\n",
+		},
+		{
+			action:   esbulk.ActionDelete,
+			response: `{"errors": true, "items": [{"delete": {"status": 404, "result": "not_found"}}]}`,
+			body:     "{\"delete\": {\"_index\":\"exampleIndex\",\"_type\":\"default\",\"_id\":\"1\"}}\n",
+		},
+	}
+	for _, c := range cases {
+		var body string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = string(b)
+			rw.Write([]byte(c.response))
+		}))
+
+		options := esbulk.Options{
+			Servers:    []string{server.URL},
+			Index:      "exampleIndex",
+			DocType:    "default",
+			IDField:    "id",
+			Action:     c.action,
+			MaxRetries: 1,
+		}
+		if err := esbulk.BulkIndex([]string{`{"id": "1", "a": 1}`}, options); err != nil {
+			t.Errorf("%s: %v", c.action, err)
+		}
+		if body != c.body {
+			t.Errorf("%s: expected body %q, got %q", c.action, c.body, body)
+		}
+		server.Close()
+	}
+}
+
+func TestBulkIndexCompress(t *testing.T) {
+	var encoding, body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		encoding = req.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		body = string(b)
+		rw.Write([]byte(`{"errors": false, "items": [{"index": {"status": 201}}, {"index": {"status": 201}}]}`))
+	}))
+	defer server.Close()
+
+	options := esbulk.Options{
+		Servers:       []string{server.URL},
+		Index:         "exampleIndex",
+		DocType:       "default",
+		MaxRetries:    1,
+		Compress:      true,
+		CompressLevel: 9,
+	}
+	// Twice, so a pooled writer is used.
+	for i := 0; i < 2; i++ {
+		if err := esbulk.BulkIndex([]string{`{"a": 1}`, `{"a": 2}`}, options); err != nil {
+			t.Fatal(err)
+		}
+		if encoding != "gzip" {
+			t.Fatalf("expected gzip encoding, got %q", encoding)
+		}
+		expected := "{\"index\": {\"_index\":\"exampleIndex\",\"_type\":\"default\"}}\n{\"a\": 1}\n" +
+			"{\"index\": {\"_index\":\"exampleIndex\",\"_type\":\"default\"}}\n{\"a\": 2}\n"
+		if body != expected {
+			t.Fatalf("expected body %q, got %q", expected, body)
+		}
+	}
+
+	options.CompressLevel = 10
+	if err := esbulk.BulkIndex([]string{`{"a": 1}`}, options); err == nil {
+		t.Fatal("expected error for invalid compression level")
+	}
+}
+
+// benchmarkBulkIndex indexes batches of documents with about 40 fields
+// against a server, that accepts everything.
+func benchmarkBulkIndex(b *testing.B, idField string) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		rw.Write([]byte(`{"took": 1, "errors": false}`))
+	}))
+	defer server.Close()
+
+	var fields []string
+	for i := 0; i < 40; i++ {
+		fields = append(fields, fmt.Sprintf(`"field%d": "value %d with some text"`, i, i))
+	}
+	docs := make([]string, 1000)
+	for i := range docs {
+		docs[i] = fmt.Sprintf(`{"id": "%d", "meta": {"tenant": "t%d", "tags": ["a", "b"]}, %s}`,
+			i, i%7, strings.Join(fields, ", "))
+	}
+	options := esbulk.Options{
+		Servers:       []string{server.URL},
+		Index:         "exampleIndex",
+		IDField:       idField,
+		MaxRetries:    1,
+		ServerVersion: esbulk.Version{Distribution: esbulk.DistributionElasticsearch, Number: "7.10.2", Major: 7, Minor: 10},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := esbulk.BulkIndex(docs, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBulkIndex(b *testing.B)         { benchmarkBulkIndex(b, "") }
+func BenchmarkBulkIndexID(b *testing.B)       { benchmarkBulkIndex(b, "id") }
+func BenchmarkBulkIndexNestedID(b *testing.B) { benchmarkBulkIndex(b, "meta.tenant,id") }
+
+func TestBulkIndexRoutingAndVersion(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		rw.Write([]byte(`{"errors": false, "items": [{"index": {"status": 201}}]}`))
+	}))
+	defer server.Close()
+
+	options := esbulk.Options{
+		Servers:       []string{server.URL},
+		Index:         "exampleIndex",
+		IDField:       "id",
+		RoutingField:  "tenant.name",
+		VersionField:  "v",
+		VersionType:   esbulk.VersionTypeExternal,
+		MaxRetries:    1,
+		ServerVersion: esbulk.Version{Distribution: esbulk.DistributionElasticsearch, Number: "7.10.2", Major: 7, Minor: 10},
+	}
+	doc := `{"id": 1, "tenant": {"name": "x"}, "v": 42}`
+	if err := esbulk.BulkIndex([]string{doc}, options); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"index": {"_index":"exampleIndex","_id":"1","routing":"x","version":42,"version_type":"external"}}` + "\n" + doc + "\n"
+	if body != expected {
+		t.Fatalf("expected body %q, got %q", expected, body)
+	}
+
+	options.VersionField, options.VersionType = "", ""
+	options.IfSeqNoField, options.IfPrimaryTermField = "seq", "term"
+	doc = `{"id": 1, "seq": 7, "term": 1}`
+	if err := esbulk.BulkIndex([]string{doc}, options); err != nil {
+		t.Fatal(err)
+	}
+	// A missing routing field is left out.
+	expected = `{"index": {"_index":"exampleIndex","_id":"1","if_seq_no":7,"if_primary_term":1}}` + "\n" + doc + "\n"
+	if body != expected {
+		t.Fatalf("expected body %q, got %q", expected, body)
+	}
+
+	if err := esbulk.BulkIndex([]string{`{"id": 1, "seq": "x", "term": 1}`}, options); err == nil {
+		t.Fatal("expected error for a sequence number, that is not an integer")
+	}
+	options.IfPrimaryTermField = ""
+	if err := esbulk.BulkIndex([]string{doc}, options); err == nil {
+		t.Fatal("expected error for a sequence number without primary term")
+	}
+}
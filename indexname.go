@@ -0,0 +1,121 @@
+package esbulk
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// isIndexTemplate reports whether an index name is a template, like
+// "events-{@timestamp:2006.01.02}" or "{tenant}-orders", that is resolved
+// for each document.
+func isIndexTemplate(index string) bool {
+	return strings.ContainsAny(index, "{}")
+}
+
+// indexParts returns the parts of an index template, or nil for a plain
+// index name.
+func indexParts(options Options) ([]templatePart, error) {
+	if !isIndexTemplate(options.Index) {
+		return nil, nil
+	}
+	return parseTemplate(options.Index, "index")
+}
+
+// checkIndex returns an error, if the index template is invalid.
+func checkIndex(options Options) error {
+	if !isIndexTemplate(options.Index) {
+		return nil
+	}
+	if options.BulkInput {
+		return fmt.Errorf("bulk input cannot be used with an index template")
+	}
+	_, err := indexParts(options)
+	return err
+}
+
+// resolveIndex puts the index name together from the parts and the raw values
+// of the fields. Index names must be lowercase, so the result is lowercased.
+func resolveIndex(parts []templatePart, values []string) (string, error) {
+	var b strings.Builder
+	i := 0
+	for _, p := range parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		v := values[i]
+		i++
+		if v == "" || v == "null" {
+			return "", invalidDocumentError{fmt.Errorf("document has no index field (%s)", p.field)}
+		}
+		if p.layout != "" {
+			s, err := formatTime(v, p.layout)
+			if err != nil {
+				return "", invalidDocumentError{fmt.Errorf("invalid index field (%s): %v", p.field, err)}
+			}
+			b.WriteString(s)
+			continue
+		}
+		s, ok := scalarString(v)
+		if !ok {
+			return "", invalidDocumentError{fmt.Errorf("cannot convert index value to string (%s)", p.field)}
+		}
+		b.WriteString(s)
+	}
+	return strings.ToLower(b.String()), nil
+}
+
+// indexSet prepares the indexes named by a template the first time a document
+// for them shows up, like a single index is prepared before indexing, and
+// restores their settings at the end.
+type indexSet struct {
+	options  Options
+	mu       sync.Mutex
+	prepared map[string]error
+	restores []func() error
+}
+
+func newIndexSet(options Options) *indexSet {
+	return &indexSet{options: options, prepared: make(map[string]error)}
+}
+
+// prepare creates the index, puts the mapping and applies the bulk settings,
+// once. Workers wait for an index another worker prepares, since their
+// documents would otherwise create it with default settings.
+func (s *indexSet) prepare(index string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err, ok := s.prepared[index]; ok {
+		return err
+	}
+	if s.options.Verbose {
+		log.Printf("preparing index %s", index)
+	}
+	options := s.options
+	options.Index = index
+	restore, err := prepareIndex(options)
+	if restore != nil {
+		s.restores = append(s.restores, restore)
+	}
+	s.prepared[index] = err
+	return err
+}
+
+// restore restores the settings of all prepared indexes and returns the first
+// error.
+func (s *indexSet) restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, restore := range s.restores {
+		if rerr := restore(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	if s.options.Verbose {
+		log.Printf("restored settings of %d indexes", len(s.restores))
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package esbulk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewBulkActionIndexTemplate(t *testing.T) {
+	var cases = []struct {
+		index string
+		doc   string
+		want  string
+		err   bool
+	}{
+		{"{tenant}-orders", `{"tenant": "ACME"}`, "acme-orders", false},
+		{"events-{@timestamp:2006.01.02}", `{"@timestamp": "2018-11-13T10:23:00Z"}`, "events-2018.11.13", false},
+		{"{t.id}-{ts:2006.01}", `{"t": {"id": 7}, "ts": 1542104580000}`, "7-2018.11", false},
+		{"{tenant}-orders", `{"tenant": null}`, "", true},
+		{"{tenant}-orders", `{"tenant": {"a": 1}}`, "", true},
+		{"events-{ts:2006}", `{"ts": "soon"}`, "", true},
+	}
+	for _, c := range cases {
+		options := Options{Index: c.index, ServerVersion: Version{Major: 7}}
+		action, err := newBulkAction(c.doc, options)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.doc, err, c.err)
+			continue
+		}
+		if _, ok := err.(invalidDocumentError); err != nil && !ok {
+			t.Errorf("%s: expected an invalid document error, got %v", c.doc, err)
+		}
+		if action.index != c.want {
+			t.Errorf("%s: got index %q, want %q", c.doc, action.index, c.want)
+		}
+	}
+}
+
+func TestCreateIndexFromLDJFileIndexTemplate(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.NumWorkers = 2
+	options.Index = "events-{ts:2006.01.02}"
+	options.Mapping = `{"properties": {}}`
+
+	r := strings.NewReader(`{"ts": "2018-11-13T10:00:00Z"}
+{"ts": "2018-11-14T10:00:00Z"}
+{"ts": "2018-11-13T11:00:00Z"}
+`)
+	if _, err := CreateIndexFromLDJFile(r, options); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []string{"events-2018.11.13", "events-2018.11.14"} {
+		if len(cluster.find("GET /"+index+" ")) != 1 {
+			t.Errorf("expected %s to be created once, got %v", index, cluster.requests)
+		}
+		if len(cluster.find("PUT /"+index+"/_mapping")) != 1 {
+			t.Errorf("expected a mapping for %s, got %v", index, cluster.requests)
+		}
+		if len(cluster.find("POST /"+index+"/_flush")) != 1 {
+			t.Errorf("expected settings of %s to be restored, got %v", index, cluster.requests)
+		}
+	}
+	if len(cluster.find("PUT /events-{")) > 0 {
+		t.Errorf("expected no request for the template itself, got %v", cluster.requests)
+	}
+}
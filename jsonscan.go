@@ -0,0 +1,277 @@
+package esbulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// span is a byte range in a document.
+type span struct {
+	start, end int
+}
+
+// fieldPath is a dotted field name, like "user.id", split into its parts.
+type fieldPath struct {
+	parts []string
+	index int // Position in the list of requested fields.
+}
+
+// jsonScanner picks field values out of a JSON object without decoding the
+// whole document. Values, that are not asked for, are only skipped over, and
+// scanning stops as soon as all values are found.
+type jsonScanner struct {
+	s       string
+	i       int
+	missing int  // Number of values not found yet.
+	full    bool // Scan the whole document, e.g. to record the members.
+}
+
+// scanFields returns the raw JSON values of the given dotted fields, an empty
+// string marks a missing field. If members is not nil, the spans of all top
+// level members (from the key to the end of the value) are appended to it.
+func scanFields(doc string, fields []string, members *[]span) ([]string, error) {
+	paths := make([]fieldPath, len(fields))
+	for i, f := range fields {
+		paths[i] = fieldPath{parts: strings.Split(f, "."), index: i}
+	}
+	values := make([]string, len(fields))
+	sc := &jsonScanner{s: doc, missing: len(fields), full: members != nil}
+	sc.skipSpace()
+	if sc.peek() != '{' {
+		return nil, sc.errorf("expected object")
+	}
+	if err := sc.scanObject(paths, 0, values, members); err != nil {
+		return nil, err
+	}
+	if sc.done(paths) {
+		return values, nil
+	}
+	sc.skipSpace()
+	if sc.i < len(sc.s) {
+		return nil, sc.errorf("unexpected data after object")
+	}
+	return values, nil
+}
+
+// done reports whether a scan for fields can stop early. Objects, that are
+// only skipped over, are always scanned to the end.
+func (sc *jsonScanner) done(paths []fieldPath) bool {
+	return len(paths) > 0 && !sc.full && sc.missing == 0
+}
+
+func (sc *jsonScanner) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, a...), sc.i)
+}
+
+func (sc *jsonScanner) peek() byte {
+	if sc.i < len(sc.s) {
+		return sc.s[sc.i]
+	}
+	return 0
+}
+
+func (sc *jsonScanner) skipSpace() {
+	for sc.i < len(sc.s) {
+		switch sc.s[sc.i] {
+		case ' ', '\t', '\n', '\r':
+			sc.i++
+		default:
+			return
+		}
+	}
+}
+
+// scanObject scans an object, the scanner is positioned at the opening brace.
+// Values of paths, that end at this depth, are recorded, the others are
+// followed into nested objects.
+func (sc *jsonScanner) scanObject(paths []fieldPath, depth int, values []string, members *[]span) error {
+	sc.i++ // {
+	sc.skipSpace()
+	if sc.peek() == '}' {
+		sc.i++
+		return nil
+	}
+	var nested []fieldPath
+	for {
+		sc.skipSpace()
+		start := sc.i
+		key, err := sc.scanKey()
+		if err != nil {
+			return err
+		}
+		sc.skipSpace()
+		if sc.peek() != ':' {
+			return sc.errorf("expected colon after object key")
+		}
+		sc.i++
+		sc.skipSpace()
+
+		nested = nested[:0]
+		valueStart := sc.i
+		for _, p := range paths {
+			if len(p.parts) > depth+1 && p.parts[depth] == key {
+				nested = append(nested, p)
+			}
+		}
+		if len(nested) > 0 && sc.peek() == '{' {
+			if err := sc.scanObject(nested, depth+1, values, nil); err != nil {
+				return err
+			}
+		} else if err := sc.skipValue(); err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if len(p.parts) == depth+1 && p.parts[depth] == key {
+				if values[p.index] == "" {
+					sc.missing--
+				}
+				values[p.index] = sc.s[valueStart:sc.i]
+			}
+		}
+		if members != nil {
+			*members = append(*members, span{start, sc.i})
+		}
+		if sc.done(paths) {
+			return nil
+		}
+
+		sc.skipSpace()
+		switch sc.peek() {
+		case ',':
+			sc.i++
+		case '}':
+			sc.i++
+			return nil
+		default:
+			return sc.errorf("expected comma or closing brace")
+		}
+	}
+}
+
+// scanKey scans an object key and returns it unquoted.
+func (sc *jsonScanner) scanKey() (string, error) {
+	start := sc.i
+	if err := sc.skipString(); err != nil {
+		return "", err
+	}
+	return unquote(sc.s[start:sc.i])
+}
+
+// skipString skips over a string, the scanner is positioned at the quote.
+// The content is not validated.
+func (sc *jsonScanner) skipString() error {
+	if sc.peek() != '"' {
+		return sc.errorf("expected string")
+	}
+	sc.i++
+	for {
+		j := strings.IndexByte(sc.s[sc.i:], '"')
+		if j < 0 {
+			sc.i = len(sc.s)
+			return sc.errorf("unterminated string")
+		}
+		sc.i += j + 1
+		// The quote is escaped, if it follows an odd number of backslashes.
+		n := 0
+		for k := sc.i - 2; sc.s[k] == '\\'; k-- {
+			n++
+		}
+		if n%2 == 0 {
+			return nil
+		}
+	}
+}
+
+// skipValue skips over any value.
+func (sc *jsonScanner) skipValue() error {
+	switch c := sc.peek(); {
+	case c == '"':
+		return sc.skipString()
+	case c == '{':
+		return sc.scanObject(nil, 0, nil, nil)
+	case c == '[':
+		sc.i++
+		sc.skipSpace()
+		if sc.peek() == ']' {
+			sc.i++
+			return nil
+		}
+		for {
+			sc.skipSpace()
+			if err := sc.skipValue(); err != nil {
+				return err
+			}
+			sc.skipSpace()
+			switch sc.peek() {
+			case ',':
+				sc.i++
+			case ']':
+				sc.i++
+				return nil
+			default:
+				return sc.errorf("expected comma or closing bracket")
+			}
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		for sc.i < len(sc.s) && strings.IndexByte("+-.eE0123456789", sc.s[sc.i]) >= 0 {
+			sc.i++
+		}
+		return nil
+	default:
+		for _, lit := range []string{"true", "false", "null"} {
+			if strings.HasPrefix(sc.s[sc.i:], lit) {
+				sc.i += len(lit)
+				return nil
+			}
+		}
+		return sc.errorf("invalid character %q", c)
+	}
+}
+
+// unquote returns the content of a JSON string, decoding only if there are
+// escape sequences.
+func unquote(raw string) (string, error) {
+	if strings.IndexByte(raw, '\\') < 0 {
+		return raw[1 : len(raw)-1], nil
+	}
+	var s string
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// scalarString returns the string representation of a raw string, number or
+// boolean value; numbers are used as written, like json.Number does.
+func scalarString(raw string) (string, bool) {
+	switch c := raw[0]; {
+	case c == '"':
+		s, err := unquote(raw)
+		return s, err == nil
+	case c == '-' || (c >= '0' && c <= '9'), raw == "true", raw == "false":
+		return raw, true
+	}
+	return "", false
+}
+
+// removeMember removes all top level members with the given key from an
+// object, keeping the rest of the document byte for byte.
+func removeMember(doc string, members []span, key string) string {
+	var kept []string
+	removed := false
+	for _, m := range members {
+		sc := &jsonScanner{s: doc, i: m.start}
+		if k, err := sc.scanKey(); err == nil && k == key {
+			removed = true
+			continue
+		}
+		kept = append(kept, doc[m.start:m.end])
+	}
+	if !removed {
+		return doc
+	}
+	open := strings.IndexByte(doc, '{')
+	closing := strings.LastIndexByte(doc, '}')
+	return doc[:open+1] + strings.Join(kept, ",") + doc[closing:]
+}
@@ -0,0 +1,86 @@
+package esbulk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanFields(t *testing.T) {
+	var cases = []struct {
+		doc    string
+		fields []string
+		values []string
+		err    bool
+	}{
+		{`{"id": "1"}`, []string{"id"}, []string{`"1"`}, false},
+		{`{"a": [1, {"id": 2}], "id": 12.5e3}`, []string{"id"}, []string{`12.5e3`}, false},
+		{`{"user": {"name": {"first": "x"}, "id": 7}, "ts": "t"}`, []string{"user.id", "ts", "user.name.first"},
+			[]string{`7`, `"t"`, `"x"`}, false},
+		{`{"user": "x"}`, []string{"user.id"}, []string{""}, false},
+		{`{"a": "\"}", "b\"": 1, "id": "1"}`, []string{"id", `b"`}, []string{`"1"`, `1`}, false},
+		{`{"id": {"x": 1}}`, []string{"id"}, []string{`{"x": 1}`}, false},
+		{` { } `, []string{"id"}, []string{""}, false},
+		{`{"id": 1, "x": [1, }`, []string{"x"}, nil, true},
+		{`{"id": "1}`, []string{"id"}, nil, true},
+		{`[1, 2]`, []string{"id"}, nil, true},
+		{`{"x": 1} 2`, []string{"id"}, nil, true},
+		{`{"x": nope}`, []string{"id"}, nil, true},
+		// Scanning stops, once all fields are found.
+		{`{"id": 1, "x": [1, }`, []string{"id"}, []string{`1`}, false},
+	}
+	for _, c := range cases {
+		values, err := scanFields(c.doc, c.fields, nil)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.doc, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%s: got %q, want %q", c.doc, values, c.values)
+		}
+	}
+}
+
+func TestScalarString(t *testing.T) {
+	var cases = []struct {
+		raw string
+		s   string
+		ok  bool
+	}{
+		{`"abc"`, "abc", true},
+		{`"aä\n"`, "aä\n", true},
+		{`-12.50`, "-12.50", true},
+		{`true`, "true", true},
+		{`null`, "", false},
+		{`[1]`, "", false},
+		{`{}`, "", false},
+	}
+	for _, c := range cases {
+		s, ok := scalarString(c.raw)
+		if s != c.s || ok != c.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", c.raw, s, ok, c.s, c.ok)
+		}
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	var cases = []struct {
+		doc    string
+		result string
+	}{
+		{`{"_id": "1", "a": 1}`, `{"a": 1}`},
+		{`{"a": 1, "_id": "1"}`, `{"a": 1}`},
+		{`{"a": {"_id": 2}, "_id": "1", "b": [1, 2]}`, `{"a": {"_id": 2},"b": [1, 2]}`},
+		{`{"_id": "1"}`, `{}`},
+		{`{"_id": "1", "_id": "2"}`, `{}`},
+		{`{"a": 1}`, `{"a": 1}`},
+	}
+	for _, c := range cases {
+		var members []span
+		if _, err := scanFields(c.doc, []string{"_id"}, &members); err != nil {
+			t.Fatal(err)
+		}
+		if result := removeMember(c.doc, members, "_id"); result != c.result {
+			t.Errorf("%s: got %s, want %s", c.doc, result, c.result)
+		}
+	}
+}
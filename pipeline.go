@@ -0,0 +1,103 @@
+package esbulk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// readStringOrFile returns s itself, if it is a JSON object, or else the
+// contents of the file named s, if there is one. Long inline JSON is not
+// even a valid file name.
+func readStringOrFile(s string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return []byte(s), nil
+	}
+	if _, err := os.Stat(s); err != nil {
+		return []byte(s), nil
+	}
+	return ioutil.ReadFile(s)
+}
+
+// PutPipeline creates or replaces an ingest pipeline.
+func PutPipeline(options Options, name string, body io.Reader) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_ingest/pipeline/%s", server, url.PathEscape(name))
+
+	req, err := MakeHTTPRequest(options, "PUT", link, body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to put pipeline %s with %s: %s", name, resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("put pipeline %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// PipelineExists reports whether an ingest pipeline exists.
+func PipelineExists(options Options, name string) (bool, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_ingest/pipeline/%s", server, url.PathEscape(name))
+
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not check pipeline %s: %s", name, resp.Status)
+	}
+}
+
+// preparePipeline uploads the pipeline definition, if there is one, or makes
+// sure the pipeline exists, so a missing pipeline fails before indexing.
+func preparePipeline(options Options) error {
+	if options.Pipeline == "" {
+		if options.PipelineDefinition != "" {
+			return fmt.Errorf("a pipeline definition requires a pipeline name")
+		}
+		return nil
+	}
+	if options.PipelineDefinition != "" {
+		b, err := readStringOrFile(options.PipelineDefinition)
+		if err != nil {
+			return err
+		}
+		return PutPipeline(options, options.Pipeline, bytes.NewReader(b))
+	}
+	exists, err := PipelineExists(options, options.Pipeline)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ingest pipeline %s does not exist", options.Pipeline)
+	}
+	return nil
+}
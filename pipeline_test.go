@@ -0,0 +1,83 @@
+package esbulk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateIndexFromLDJFilePipeline(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.NumWorkers = 1
+	options.BatchSize = 2
+	options.Pipeline = "my pipeline"
+	options.PipelineField = "p"
+	options.PipelineDefinition = `{"processors": []}`
+
+	r := strings.NewReader("{\"a\": 1}\n{\"a\": 2, \"p\": \"other\"}\n")
+	if _, err := CreateIndexFromLDJFile(r, options); err != nil {
+		t.Fatal(err)
+	}
+	if put := cluster.find(`PUT /_ingest/pipeline/my%20pipeline {"processors": []}`); len(put) != 1 {
+		t.Fatalf("expected the pipeline to be uploaded, got %v", cluster.requests)
+	}
+	bulk := cluster.find("POST /_bulk?pipeline=my+pipeline ")
+	if len(bulk) != 1 {
+		t.Fatalf("expected a bulk request with the pipeline, got %v", cluster.requests)
+	}
+	if !strings.Contains(bulk[0], `"_type":"default","pipeline":"other"}}`) {
+		t.Errorf("expected the pipeline of the document in the header, got %s", bulk[0])
+	}
+}
+
+func TestCreateIndexFromLDJFileMissingPipeline(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.Pipeline = "missing"
+
+	_, err := CreateIndexFromLDJFile(strings.NewReader("{\"a\": 1}\n"), options)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing pipeline error, got %v", err)
+	}
+	if len(cluster.find("PUT /exampleIndex")) > 0 || len(cluster.find("POST /_bulk")) > 0 {
+		t.Errorf("expected no index to be created or written to, got %v", cluster.requests)
+	}
+}
+
+func TestReadStringOrFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esbulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pipeline.json")
+	if err := ioutil.WriteFile(path, []byte(`{"processors": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	long := `{"description": "` + strings.Repeat("x", 300) + `", "processors": []}`
+	for _, c := range []struct{ s, want string }{
+		{long, long},
+		{" " + long, " " + long},
+		{path, `{"processors": []}`},
+		{"missing.json", "missing.json"},
+	} {
+		b, err := readStringOrFile(c.s)
+		if err != nil {
+			t.Errorf("%.20s: %v", c.s, err)
+			continue
+		}
+		if string(b) != c.want {
+			t.Errorf("%.20s: got %.20s, want %.20s", c.s, b, c.want)
+		}
+	}
+}
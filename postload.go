@@ -0,0 +1,255 @@
+package esbulk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"time"
+)
+
+// Index health states to wait for after a load.
+const (
+	HealthGreen  = "green"
+	HealthYellow = "yellow"
+)
+
+// defaultPostLoadTimeout limits the steps after a load, if no timeout is given.
+const defaultPostLoadTimeout = time.Hour
+
+// postLoadPollInterval is the time between checks of a running force merge
+// or of the index health.
+var postLoadPollInterval = 5 * time.Second
+
+// healthRank orders health states, a higher rank includes the lower ones.
+var healthRank = map[string]int{"red": 1, HealthYellow: 2, HealthGreen: 3}
+
+// checkPostLoad returns an error, if the options for the steps after a load
+// are invalid.
+func checkPostLoad(options Options) error {
+	switch options.WaitFor {
+	case "", HealthGreen, HealthYellow:
+	default:
+		return fmt.Errorf("unknown health to wait for: %s", options.WaitFor)
+	}
+	if options.ForceMerge < 0 {
+		return fmt.Errorf("number of segments to merge to must not be negative")
+	}
+	return nil
+}
+
+// hasPostLoad reports whether there are steps to run after a load.
+func hasPostLoad(options Options) bool {
+	return options.ForceMerge > 0 || options.WaitFor != ""
+}
+
+// FinishIndex runs the steps after a load, that are requested: a force merge,
+// a refresh and waiting for the index health, all within the timeout.
+func FinishIndex(ctx context.Context, options Options) error {
+	if err := checkPostLoad(options); err != nil || !hasPostLoad(options) {
+		return err
+	}
+	timeout := options.PostLoadTimeout
+	if timeout <= 0 {
+		timeout = defaultPostLoadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if options.ForceMerge > 0 {
+		if err := ForceMergeIndex(ctx, options, options.ForceMerge); err != nil {
+			return err
+		}
+	}
+	if err := RefreshIndex(options); err != nil {
+		return err
+	}
+	if options.WaitFor != "" {
+		return WaitForHealth(ctx, options, options.WaitFor)
+	}
+	return nil
+}
+
+// RefreshIndex makes all documents of the index visible to search.
+func RefreshIndex(options Options) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/%s/_refresh", server, options.Index)
+	req, err := MakeHTTPRequest(options, "POST", link, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to refresh index with %s: %s", resp.Status, buf.String())
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if options.Verbose {
+		log.Printf("index refreshed: %s", resp.Status)
+	}
+	return nil
+}
+
+// ForceMergeIndex merges the segments of each shard of the index down to at
+// most maxSegments. The merge runs as a task, which is polled until it
+// completes or the context is done. Servers, that cannot run a force merge
+// as a task, are waited for.
+func ForceMergeIndex(ctx context.Context, options Options, maxSegments int) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/%s/_forcemerge?max_num_segments=%d", server, options.Index, maxSegments)
+	if options.Verbose {
+		log.Printf("force merging %s to %d segments", options.Index, maxSegments)
+	}
+	var task struct {
+		Task string `json:"task"`
+	}
+	status, err := postJSON(ctx, options, link+"&wait_for_completion=false", &task)
+	if status == 400 {
+		// Before elasticsearch 7.7, the parameter is unknown.
+		_, err = postJSON(ctx, options, link, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to force merge %s: %v", options.Index, err)
+	}
+	if task.Task == "" {
+		return nil
+	}
+	return waitForTask(ctx, options, task.Task, "force merge of "+options.Index)
+}
+
+// postJSON sends a POST request and decodes the response into v, if it is
+// not nil. It returns the status code along with an error response.
+func postJSON(ctx context.Context, options Options, link string, v interface{}) (int, error) {
+	req, err := MakeHTTPRequest(options, "POST", link, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := httpClient(options).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return resp.StatusCode, err
+		}
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, buf.String())
+	}
+	if v == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// waitForTask polls a task, until it completes or the context is done.
+func waitForTask(ctx context.Context, options Options, id, about string) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_tasks/%s", server, url.PathEscape(id))
+	for {
+		req, err := MakeHTTPRequest(options, "GET", link, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient(options).Do(req.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("%s: %v", about, err)
+		}
+		var task struct {
+			Completed bool            `json:"completed"`
+			Error     json.RawMessage `json:"error"`
+			Task      struct {
+				RunningTimeInNanos int64 `json:"running_time_in_nanos"`
+			} `json:"task"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&task)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 400:
+			return fmt.Errorf("%s: could not get task %s: %s", about, id, resp.Status)
+		case err != nil:
+			return fmt.Errorf("%s: failed to decode task: %v", about, err)
+		case task.Completed && task.Error != nil:
+			return fmt.Errorf("%s failed: %s", about, task.Error)
+		case task.Completed:
+			if options.Verbose {
+				log.Printf("%s done", about)
+			}
+			return nil
+		}
+		if options.Verbose {
+			log.Printf("%s running for %s", about, time.Duration(task.Task.RunningTimeInNanos).Round(time.Second))
+		}
+		select {
+		case <-time.After(postLoadPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("%s not done: %v", about, ctx.Err())
+		}
+	}
+}
+
+// WaitForHealth polls the health of the index, until it is at least the
+// given one, green or yellow, or the context is done.
+func WaitForHealth(ctx context.Context, options Options, health string) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_cluster/health/%s", server, options.Index)
+	status := "unknown"
+	for {
+		req, err := MakeHTTPRequest(options, "GET", link, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient(options).Do(req.WithContext(ctx))
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("index %s is %s, not %s: %v", options.Index, status, health, ctx.Err())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get health of %s: %v", options.Index, err)
+		}
+		var h struct {
+			Status             string `json:"status"`
+			RelocatingShards   int    `json:"relocating_shards"`
+			InitializingShards int    `json:"initializing_shards"`
+			UnassignedShards   int    `json:"unassigned_shards"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&h)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("could not get health of %s: %s", options.Index, resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode health of %s: %v", options.Index, err)
+		}
+		status = h.Status
+		if healthRank[status] >= healthRank[health] {
+			if options.Verbose {
+				log.Printf("index %s is %s", options.Index, h.Status)
+			}
+			return nil
+		}
+		if options.Verbose {
+			log.Printf("index %s is %s, waiting for %s (%d initializing, %d relocating, %d unassigned shards)",
+				options.Index, h.Status, health, h.InitializingShards, h.RelocatingShards, h.UnassignedShards)
+		}
+		select {
+		case <-time.After(postLoadPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("index %s is %s, not %s: %v", options.Index, h.Status, health, ctx.Err())
+		}
+	}
+}
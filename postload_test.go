@@ -0,0 +1,96 @@
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFinishIndex(t *testing.T) {
+	defer func(d time.Duration) { postLoadPollInterval = d }(postLoadPollInterval)
+	postLoadPollInterval = time.Millisecond
+
+	var (
+		mu       sync.Mutex
+		requests []string
+		polls    int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.Method+" "+req.URL.RequestURI())
+		polls++
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/_forcemerge"):
+			fmt.Fprint(rw, `{"task": "node:1"}`)
+		case req.URL.Path == "/_tasks/node:1":
+			fmt.Fprintf(rw, `{"completed": %v, "task": {"running_time_in_nanos": 1000}}`, polls > 3)
+		case strings.HasPrefix(req.URL.Path, "/_cluster/health/"):
+			status := "yellow"
+			if polls > 6 {
+				status = "green"
+			}
+			fmt.Fprintf(rw, `{"status": %q}`, status)
+		default:
+			fmt.Fprint(rw, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	options := Options{Servers: []string{server.URL}, Index: "example", MaxRetries: 1, ForceMerge: 1, WaitFor: HealthGreen}
+	if err := FinishIndex(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST /example/_forcemerge?max_num_segments=1&wait_for_completion=false",
+		"GET /_tasks/node:1",
+		"GET /_tasks/node:1",
+		"GET /_tasks/node:1",
+		"POST /example/_refresh",
+		"GET /_cluster/health/example",
+		"GET /_cluster/health/example",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", requests, want)
+	}
+}
+
+func TestFinishIndexTimeout(t *testing.T) {
+	defer func(d time.Duration) { postLoadPollInterval = d }(postLoadPollInterval)
+	postLoadPollInterval = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, `{"status": "red"}`)
+	}))
+	defer server.Close()
+
+	options := Options{Servers: []string{server.URL}, Index: "example", MaxRetries: 1, WaitFor: HealthYellow, PostLoadTimeout: 20 * time.Millisecond}
+	err := FinishIndex(context.Background(), options)
+	if err == nil || !strings.Contains(err.Error(), "is red, not yellow") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if err := FinishIndex(context.Background(), Options{WaitFor: "blue"}); err == nil {
+		t.Error("expected an error for an unknown health")
+	}
+}
+
+func TestWaitForHealthError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(rw, `{"error": {"type": "index_not_found_exception"}}`)
+	}))
+	defer server.Close()
+
+	options := Options{Servers: []string{server.URL}, Index: "example", MaxRetries: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := WaitForHealth(ctx, options, HealthGreen)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected an error for a missing index, got %v", err)
+	}
+}
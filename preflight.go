@@ -0,0 +1,360 @@
+package esbulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Handling of the checks before indexing.
+const (
+	PreflightOff    = "off"    // No checks (default).
+	PreflightWarn   = "warn"   // All problems are logged as warnings.
+	PreflightRefuse = "refuse" // Problems, that would make the load fail, stop it before it starts.
+)
+
+// PreflightProblem is a problem found before indexing. Fatal problems would
+// make the load fail sooner or later, the others may slow it down.
+type PreflightProblem struct {
+	Fatal   bool
+	Message string
+}
+
+func (p PreflightProblem) String() string {
+	if p.Fatal {
+		return "error: " + p.Message
+	}
+	return "warning: " + p.Message
+}
+
+// CheckCluster checks the cluster health, the disk space of the data nodes
+// against the disk watermarks and the queues of the write thread pools. A
+// check, that cannot be done, e.g. for missing privileges, is reported as a
+// warning.
+func CheckCluster(options Options) []PreflightProblem {
+	return runChecks(options, checkHealth, checkDisk, checkThreadPools)
+}
+
+// CheckIndex checks, whether the index, if it exists, is blocked for writes.
+func CheckIndex(options Options) []PreflightProblem {
+	return runChecks(options, checkIndexBlocks)
+}
+
+func runChecks(options Options, checks ...func(Options) ([]PreflightProblem, error)) []PreflightProblem {
+	var problems []PreflightProblem
+	for _, check := range checks {
+		p, err := check(options)
+		if err != nil {
+			p = append(p, PreflightProblem{Message: err.Error()})
+		}
+		problems = append(problems, p...)
+	}
+	return problems
+}
+
+// ClusterChecks keeps the problems of the cluster, found by the first load,
+// that shares it, so a run with many loads, e.g. of the files of a directory,
+// checks the cluster once. The zero value is ready to use.
+type ClusterChecks struct {
+	mu       sync.Mutex
+	checked  bool
+	problems []PreflightProblem
+}
+
+// get returns the problems of the cluster, and whether they were found
+// before. Without checks to share, the cluster is checked every time.
+func (c *ClusterChecks) get(options Options) ([]PreflightProblem, bool) {
+	if c == nil {
+		return CheckCluster(options), false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked {
+		return c.problems, true
+	}
+	c.problems, c.checked = CheckCluster(options), true
+	return c.problems, false
+}
+
+// preflight runs the checks before indexing, logs the problems and returns
+// an error, if there are fatal ones and the load should not start. Problems
+// of the cluster, that were found before, are not logged again.
+func preflight(options Options) error {
+	switch options.Preflight {
+	case "", PreflightOff:
+		return nil
+	case PreflightWarn, PreflightRefuse:
+	default:
+		return fmt.Errorf("unknown preflight handling: %s", options.Preflight)
+	}
+	cluster, seen := options.ClusterChecks.get(options)
+	var fatal []string
+	for _, p := range cluster {
+		if !seen {
+			log.Printf("preflight %s", p)
+		}
+		if p.Fatal {
+			fatal = append(fatal, p.Message)
+		}
+	}
+	for _, p := range CheckIndex(options) {
+		log.Printf("preflight %s", p)
+		if p.Fatal {
+			fatal = append(fatal, p.Message)
+		}
+	}
+	if len(fatal) > 0 && options.Preflight == PreflightRefuse {
+		return fmt.Errorf("refusing to start: %s", strings.Join(fatal, "; "))
+	}
+	if options.Verbose && len(fatal) == 0 {
+		log.Printf("preflight checks done")
+	}
+	return nil
+}
+
+// getJSON decodes the response to a GET request into v.
+func getJSON(options Options, path string, v interface{}) error {
+	link := PickServerURI(options.Servers) + path
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("could not check %s: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return nil
+}
+
+func checkHealth(options Options) ([]PreflightProblem, error) {
+	var h struct {
+		Status           string `json:"status"`
+		UnassignedShards int    `json:"unassigned_shards"`
+	}
+	if err := getJSON(options, "/_cluster/health", &h); err != nil {
+		return nil, err
+	}
+	switch h.Status {
+	case "red":
+		return []PreflightProblem{{Fatal: true, Message: fmt.Sprintf(
+			"cluster health is red, %d shards are unassigned, some primary shards are missing and cannot be written to", h.UnassignedShards)}}, nil
+	case HealthYellow:
+		return []PreflightProblem{{Message: fmt.Sprintf(
+			"cluster health is yellow, %d replica shards are unassigned", h.UnassignedShards)}}, nil
+	}
+	return nil, nil
+}
+
+// watermark is a disk watermark, either as a share of the disk used or as
+// free bytes.
+type watermark struct {
+	setting     string
+	value       string
+	usedPercent float64
+	freeBytes   int64
+}
+
+// exceeded reports whether a disk with the given total and available bytes
+// is beyond the watermark.
+func (w watermark) exceeded(total, avail int64) bool {
+	if w.freeBytes > 0 {
+		return avail < w.freeBytes
+	}
+	return w.usedPercent > 0 && float64(total-avail)*100 > w.usedPercent*float64(total)
+}
+
+// parseWatermark parses a watermark, like "85%", "0.85" or "500mb".
+func parseWatermark(setting, s string) (watermark, error) {
+	w := watermark{setting: setting, value: s}
+	if strings.HasSuffix(s, "%") {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		w.usedPercent = f
+		return w, err
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && f <= 1 {
+		w.usedPercent = f * 100
+		return w, nil
+	}
+	n, err := parseByteValue(s)
+	w.freeBytes = n
+	return w, err
+}
+
+// parseByteValue parses a byte value with a unit, as elasticsearch writes
+// them, like "500mb" or "1.5gb".
+func parseByteValue(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	factor := 1.0
+	for _, u := range []struct {
+		suffix string
+		factor float64
+	}{{"pb", 1 << 50}, {"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte value: %s", s)
+	}
+	return int64(f * factor), nil
+}
+
+// formatBytes formats a number of bytes for a message, like "12.3GB".
+func formatBytes(n int64) string {
+	for _, u := range byteUnits {
+		if n >= int64(u.factor) && u.factor > 1 {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.factor), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// clusterSetting returns the effective value of a cluster setting from a
+// response with flat settings and defaults.
+func clusterSetting(doc map[string]map[string]interface{}, name string) string {
+	for _, scope := range []string{"transient", "persistent", "defaults"} {
+		if v, ok := doc[scope][name].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func checkDisk(options Options) ([]PreflightProblem, error) {
+	var settings map[string]map[string]interface{}
+	if err := getJSON(options, "/_cluster/settings?include_defaults=true&flat_settings=true", &settings); err != nil {
+		return nil, err
+	}
+	if clusterSetting(settings, "cluster.routing.allocation.disk.threshold_enabled") == "false" {
+		return nil, nil
+	}
+	// From the most severe to the least.
+	var watermarks []watermark
+	for _, name := range []string{"flood_stage", "high", "low"} {
+		setting := "cluster.routing.allocation.disk.watermark." + name
+		value := clusterSetting(settings, setting)
+		if value == "" {
+			continue
+		}
+		w, err := parseWatermark(setting, value)
+		if err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, w)
+	}
+
+	var nodes []struct {
+		Node  string `json:"node"`
+		Total string `json:"disk.total"`
+		Avail string `json:"disk.avail"`
+	}
+	if err := getJSON(options, "/_cat/allocation?format=json&bytes=b", &nodes); err != nil {
+		return nil, err
+	}
+	var problems []PreflightProblem
+	for _, n := range nodes {
+		total, err := strconv.ParseInt(n.Total, 10, 64)
+		if err != nil || total == 0 {
+			continue // Unassigned shards, or no disk information.
+		}
+		avail, _ := strconv.ParseInt(n.Avail, 10, 64)
+		used := float64(total-avail) * 100 / float64(total)
+		for _, w := range watermarks {
+			if !w.exceeded(total, avail) {
+				continue
+			}
+			p := PreflightProblem{Message: fmt.Sprintf("node %s has %s free (%.0f%% used), beyond %s %s",
+				n.Node, formatBytes(avail), used, w.setting, w.value)}
+			switch {
+			case strings.HasSuffix(w.setting, "flood_stage"):
+				p.Fatal = true
+				p.Message += ", indexes with shards on it become read-only"
+			case strings.HasSuffix(w.setting, "high"):
+				p.Message += ", shards are moved away from it"
+			default:
+				p.Message += ", no new shards are allocated to it"
+			}
+			problems = append(problems, p)
+			break
+		}
+	}
+	return problems, nil
+}
+
+func checkThreadPools(options Options) ([]PreflightProblem, error) {
+	// The bulk thread pool was renamed to write in elasticsearch 6.3.
+	var pools []struct {
+		Node      string `json:"node_name"`
+		Name      string `json:"name"`
+		Queue     string `json:"queue"`
+		QueueSize string `json:"queue_size"`
+	}
+	if err := getJSON(options, "/_cat/thread_pool/write,bulk?format=json&h=node_name,name,queue,queue_size", &pools); err != nil {
+		return nil, err
+	}
+	var problems []PreflightProblem
+	for _, p := range pools {
+		size, err := strconv.Atoi(p.QueueSize)
+		if err != nil || size < 0 {
+			continue // Unbounded.
+		}
+		queued, _ := strconv.Atoi(p.Queue)
+		switch {
+		case size < options.NumWorkers:
+			msg := fmt.Sprintf("node %s queues at most %d %s requests, less than the %d workers, requests will be rejected",
+				p.Node, size, p.Name, options.NumWorkers)
+			if !options.Adaptive {
+				msg += " (use fewer workers or -adaptive)"
+			}
+			problems = append(problems, PreflightProblem{Message: msg})
+		case queued*2 > size:
+			problems = append(problems, PreflightProblem{Message: fmt.Sprintf(
+				"node %s is busy, %d of %d %s queue slots are taken",
+				p.Node, queued, size, p.Name)})
+		}
+	}
+	return problems, nil
+}
+
+// indexBlocks explains the index blocks, that prevent writes.
+var indexBlocks = map[string]string{
+	"index.blocks.read_only_allow_delete": "which elasticsearch sets, when a node exceeds the flood stage disk watermark; " +
+		"free disk space, then remove the block with PUT /%s/_settings {\"index.blocks.read_only_allow_delete\": null}",
+	"index.blocks.read_only": "remove it with PUT /%s/_settings {\"index.blocks.read_only\": null}",
+	"index.blocks.write":     "remove it with PUT /%s/_settings {\"index.blocks.write\": null}",
+}
+
+func checkIndexBlocks(options Options) ([]PreflightProblem, error) {
+	// A purged index is created again without blocks.
+	if options.Index == "" || isIndexTemplate(options.Index) || options.Purge {
+		return nil, nil
+	}
+	exists, err := indexExists(options)
+	if err != nil || !exists {
+		return nil, err
+	}
+	settings, err := getFlatSettings(options)
+	if err != nil {
+		return nil, err
+	}
+	var problems []PreflightProblem
+	for _, name := range []string{"index.blocks.read_only_allow_delete", "index.blocks.read_only", "index.blocks.write"} {
+		if v, _ := settings[name].(string); v == "true" {
+			problems = append(problems, PreflightProblem{Fatal: true, Message: fmt.Sprintf(
+				"index %s is blocked for writes by %s, "+indexBlocks[name], options.Index, name, options.Index)})
+		}
+	}
+	return problems, nil
+}
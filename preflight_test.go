@@ -0,0 +1,151 @@
+package esbulk
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// preflightCluster answers the requests of the checks before indexing for a
+// cluster with a yellow health, a node beyond the flood stage, a small write
+// queue and an index blocked for writes.
+func preflightCluster(t *testing.T, requests *[]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		*requests = append(*requests, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+		switch req.URL.Path {
+		case "/_cluster/health":
+			fmt.Fprint(rw, `{"status": "yellow", "unassigned_shards": 2}`)
+		case "/_cluster/settings":
+			fmt.Fprint(rw, `{"persistent": {"cluster.routing.allocation.disk.watermark.low": "80%"},
+				"transient": {},
+				"defaults": {
+					"cluster.routing.allocation.disk.threshold_enabled": "true",
+					"cluster.routing.allocation.disk.watermark.low": "85%",
+					"cluster.routing.allocation.disk.watermark.high": "90%",
+					"cluster.routing.allocation.disk.watermark.flood_stage": "95%"}}`)
+		case "/_cat/allocation":
+			fmt.Fprint(rw, `[
+				{"node": "a", "disk.total": "1000", "disk.avail": "30"},
+				{"node": "b", "disk.total": "1000", "disk.avail": "180"},
+				{"node": "c", "disk.total": "1000", "disk.avail": "500"},
+				{"node": "UNASSIGNED", "disk.total": null, "disk.avail": null}]`)
+		case "/_cat/thread_pool/write,bulk":
+			fmt.Fprint(rw, `[
+				{"node_name": "a", "name": "write", "queue": "0", "queue_size": "4"},
+				{"node_name": "b", "name": "write", "queue": "150", "queue_size": "200"},
+				{"node_name": "c", "name": "write", "queue": "0", "queue_size": "200"}]`)
+		case "/example":
+			rw.WriteHeader(http.StatusOK)
+		case "/example/_settings":
+			fmt.Fprint(rw, `{"example": {"settings": {"index.blocks.read_only_allow_delete": "true"}}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestCheckCluster(t *testing.T) {
+	var requests []string
+	server := preflightCluster(t, &requests)
+	defer server.Close()
+
+	options := Options{Servers: []string{server.URL}, Index: "example", NumWorkers: 8, MaxRetries: 1}
+	var got []string
+	for _, p := range append(CheckCluster(options), CheckIndex(options)...) {
+		got = append(got, p.String())
+	}
+	want := []string{
+		"warning: cluster health is yellow, 2 replica shards are unassigned",
+		"error: node a has 30B free (97% used), beyond cluster.routing.allocation.disk.watermark.flood_stage 95%, indexes with shards on it become read-only",
+		"warning: node b has 180B free (82% used), beyond cluster.routing.allocation.disk.watermark.low 80%, no new shards are allocated to it",
+		"warning: node a queues at most 4 write requests, less than the 8 workers, requests will be rejected (use fewer workers or -adaptive)",
+		"warning: node b is busy, 150 of 200 write queue slots are taken",
+		"error: index example is blocked for writes by index.blocks.read_only_allow_delete, which elasticsearch sets, " +
+			"when a node exceeds the flood stage disk watermark; free disk space, then remove the block with " +
+			`PUT /example/_settings {"index.blocks.read_only_allow_delete": null}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCreateIndexFromLDJFilePreflight(t *testing.T) {
+	var requests []string
+	server := preflightCluster(t, &requests)
+	defer server.Close()
+
+	options := Options{
+		Servers:       []string{server.URL},
+		Index:         "example",
+		NumWorkers:    1,
+		BatchSize:     10,
+		MaxRetries:    1,
+		Preflight:     PreflightRefuse,
+		ServerVersion: Version{Distribution: DistributionElasticsearch, Number: "7.10.2", Major: 7, Minor: 10},
+	}
+	// Without shared checks, every load checks the cluster, with them, the
+	// cluster is checked once, the index for every load.
+	for _, shared := range []*ClusterChecks{nil, {}} {
+		requests = nil
+		options.ClusterChecks = shared
+		for i := 0; i < 2; i++ {
+			_, err := CreateIndexFromLDJFile(strings.NewReader(`{"a": 1}`), options)
+			if err == nil || !strings.HasPrefix(err.Error(), "refusing to start: node a has 30B free") {
+				t.Fatalf("expected the load to be refused, got %v", err)
+			}
+		}
+		counts := make(map[string]int)
+		for _, r := range requests {
+			if strings.HasPrefix(r, "PUT") || strings.HasSuffix(r, "/_bulk") {
+				t.Errorf("unexpected request before the load was refused: %s", r)
+			}
+			counts[r]++
+		}
+		want := 2
+		if shared != nil {
+			want = 1
+		}
+		if counts["GET /_cluster/health"] != want || counts["GET /example/_settings"] != 2 {
+			t.Errorf("expected %d cluster checks and two index checks, got %v", want, counts)
+		}
+	}
+
+	options.Preflight = "maybe"
+	if _, err := CreateIndexFromLDJFile(strings.NewReader(`{"a": 1}`), options); err == nil {
+		t.Error("expected an error for an unknown preflight handling")
+	}
+}
+
+func TestParseWatermark(t *testing.T) {
+	var cases = []struct {
+		value        string
+		total, avail int64
+		exceeded     bool
+	}{
+		{"85%", 100, 20, false},
+		{"85%", 100, 10, true},
+		{"0.85", 100, 10, true},
+		{"0.85", 100, 20, false},
+		{"500mb", 1 << 40, 400 << 20, true},
+		{"1.5gb", 1 << 40, 2 << 30, false},
+	}
+	for _, c := range cases {
+		w, err := parseWatermark("low", c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.exceeded(c.total, c.avail); got != c.exceeded {
+			t.Errorf("%s exceeded by %d of %d free: got %v, want %v", c.value, c.avail, c.total, got, c.exceeded)
+		}
+	}
+	if _, err := parseWatermark("low", "lots"); err == nil {
+		t.Error("expected an error for an invalid watermark")
+	}
+}
@@ -0,0 +1,125 @@
+package esbulk
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to one second worth of tokens. A request for more
+// tokens than the bucket holds waits for a full bucket and leaves a debt,
+// that later requests have to wait for, so the average rate is kept.
+type tokenBucket struct {
+	rate   float64 // Tokens per second, zero means no limit.
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate, a new bucket starts out full.
+func (b *tokenBucket) setRate(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	}
+	b.refill(now)
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	if b.rate > 0 && b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// delay returns how long to wait until n tokens can be taken.
+func (b *tokenBucket) delay(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	need := math.Min(n, b.rate)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// RateLimiter limits the number of documents and bytes sent per second,
+// across all workers. The limits can be changed while indexing.
+type RateLimiter struct {
+	mu      sync.Mutex
+	changed chan struct{} // Closed and replaced, whenever the limits change.
+	docs    tokenBucket
+	bytes   tokenBucket
+}
+
+// NewRateLimiter creates a rate limiter. A limit of zero means no limit.
+func NewRateLimiter(docsPerSec, bytesPerSec float64) *RateLimiter {
+	r := &RateLimiter{changed: make(chan struct{})}
+	r.SetLimits(docsPerSec, bytesPerSec)
+	return r
+}
+
+// SetLimits changes the limits. Waiting requests are checked against the new
+// limits right away.
+func (r *RateLimiter) SetLimits(docsPerSec, bytesPerSec float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.docs.setRate(math.Max(docsPerSec, 0), now)
+	r.bytes.setRate(math.Max(bytesPerSec, 0), now)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Limits returns the current limits in documents and bytes per second.
+func (r *RateLimiter) Limits() (docsPerSec, bytesPerSec float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.docs.rate, r.bytes.rate
+}
+
+// Wait blocks until a request with the given number of documents and bytes
+// may be sent, or the context is done.
+func (r *RateLimiter) Wait(ctx context.Context, docs, bytes int) error {
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		r.docs.refill(now)
+		r.bytes.refill(now)
+		wait := r.docs.delay(float64(docs))
+		if d := r.bytes.delay(float64(bytes)); d > wait {
+			wait = d
+		}
+		if wait == 0 {
+			r.docs.take(float64(docs))
+			r.bytes.take(float64(bytes))
+			r.mu.Unlock()
+			return nil
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package esbulk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(100, 0)
+	ctx := context.Background()
+	start := time.Now()
+	// The first 100 documents use up the full bucket, the next 50 need to
+	// wait about half a second.
+	for i := 0; i < 3; i++ {
+		if err := r.Wait(ctx, 50, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("150 docs at 100 docs/s took %s, want about 500ms", elapsed)
+	}
+}
+
+func TestRateLimiterDebt(t *testing.T) {
+	r := NewRateLimiter(0, 1000)
+	ctx := context.Background()
+	// A request larger than the bucket goes through with a full bucket and
+	// leaves a debt.
+	if err := r.Wait(ctx, 1, 1500); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx, 1, 1); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimiterSetLimits(t *testing.T) {
+	r := NewRateLimiter(1, 0)
+	ctx := context.Background()
+	if err := r.Wait(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- r.Wait(ctx, 1, 0) }()
+	time.Sleep(50 * time.Millisecond)
+	r.SetLimits(0, 0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("lifting the limit did not release the waiting request")
+	}
+	if docs, bytes := r.Limits(); docs != 0 || bytes != 0 {
+		t.Fatalf("got limits %v, %v, want 0, 0", docs, bytes)
+	}
+}
@@ -0,0 +1,245 @@
+package esbulk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// createIndexBody returns the body to create the index with: the settings,
+// with the number of shards and replicas, if given, and the mapping. It is
+// empty, if there is nothing to set. The settings may also be a whole create
+// index body, with mappings and aliases.
+func createIndexBody(options Options) ([]byte, error) {
+	settings := make(map[string]interface{})
+	body := make(map[string]interface{})
+	var mapping []byte
+	if options.Settings != "" {
+		b, err := readStringOrFile(options.Settings)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &settings); err != nil {
+			return nil, fmt.Errorf("failed to decode settings: %v", err)
+		}
+		if isCreateIndexBody(settings) {
+			var doc struct {
+				Settings map[string]interface{} `json:"settings"`
+				Mappings json.RawMessage        `json:"mappings"`
+				Aliases  json.RawMessage        `json:"aliases"`
+			}
+			for key := range settings {
+				switch key {
+				case "settings", "mappings", "aliases":
+				default:
+					return nil, fmt.Errorf("settings mix a create index body with %q", key)
+				}
+			}
+			if err := json.Unmarshal(b, &doc); err != nil {
+				return nil, fmt.Errorf("failed to decode settings: %v", err)
+			}
+			settings = doc.Settings
+			if settings == nil {
+				settings = make(map[string]interface{})
+			}
+			if doc.Mappings != nil {
+				if options.Mapping != "" {
+					return nil, fmt.Errorf("mappings are given both with the settings and as a mapping, use one")
+				}
+				mapping = doc.Mappings
+			}
+			if doc.Aliases != nil {
+				body["aliases"] = doc.Aliases
+			}
+		}
+	}
+	if options.Shards > 0 {
+		setIndexSetting(settings, "number_of_shards", options.Shards)
+	}
+	if options.Replicas != nil {
+		setIndexSetting(settings, "number_of_replicas", *options.Replicas)
+	}
+
+	if len(settings) > 0 {
+		body["settings"] = settings
+	}
+	if options.Mapping != "" {
+		b, err := readStringOrFile(options.Mapping)
+		if err != nil {
+			return nil, err
+		}
+		mapping = b
+	}
+	if mapping != nil {
+		m := json.RawMessage(unwrapTypedMapping(mapping, options.DocType))
+		if !json.Valid(m) {
+			return nil, fmt.Errorf("invalid mapping: %s", mapping)
+		}
+		if options.ServerVersion.Typeless() || options.DocType == "" {
+			body["mappings"] = m
+		} else {
+			body["mappings"] = map[string]json.RawMessage{options.DocType: m}
+		}
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(body)
+}
+
+// isCreateIndexBody reports whether settings are given as a whole create
+// index body, like {"settings": ..., "mappings": ...}, instead of the index
+// settings alone.
+func isCreateIndexBody(settings map[string]interface{}) bool {
+	for _, key := range []string{"settings", "mappings", "aliases"} {
+		if _, ok := settings[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bulkSettings returns the index settings to apply during a load, with
+// dotted names: refreshing is turned off, replicas are dropped, if requested,
+// and the settings given for the load are added, they take precedence.
+func bulkSettings(options Options) (map[string]interface{}, error) {
+	settings := map[string]interface{}{"index.refresh_interval": "-1"}
+	if options.ZeroReplica {
+		settings["index.number_of_replicas"] = "0"
+	}
+	if options.BulkSettings != "" {
+		b, err := readStringOrFile(options.BulkSettings)
+		if err != nil {
+			return nil, err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("failed to decode bulk settings: %v", err)
+		}
+		flattenSettings("", doc, settings)
+	}
+	return settings, nil
+}
+
+// flattenSettings adds nested settings to flat with dotted names, all
+// starting with "index.", like {"translog": {"durability": "async"}} as
+// "index.translog.durability".
+func flattenSettings(prefix string, doc, flat map[string]interface{}) {
+	for key, value := range doc {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettings(prefix+key+".", nested, flat)
+			continue
+		}
+		name := prefix + key
+		if !strings.HasPrefix(name, "index.") {
+			name = "index." + name
+		}
+		flat[name] = value
+	}
+}
+
+// getFlatSettings returns the settings of the index, that are set, with
+// dotted names.
+func getFlatSettings(options Options) (map[string]interface{}, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/%s/_settings?flat_settings=true", server, options.Index)
+
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("could not get settings: %s", link)
+	}
+	var doc map[string]struct {
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode settings: %v", err)
+	}
+	// The response is keyed by the concrete index, also for an alias.
+	if v, ok := doc[options.Index]; ok {
+		return v.Settings, nil
+	}
+	if len(doc) == 1 {
+		for _, v := range doc {
+			return v.Settings, nil
+		}
+	}
+	return nil, fmt.Errorf("settings not found for index %s", options.Index)
+}
+
+// setIndexSetting sets an index setting, replacing it, if it is already
+// given in one of the forms elasticsearch accepts: "name", "index.name" or
+// nested in "index".
+func setIndexSetting(settings map[string]interface{}, name string, value interface{}) {
+	delete(settings, name)
+	delete(settings, "index."+name)
+	if index, ok := settings["index"].(map[string]interface{}); ok {
+		index[name] = value
+		return
+	}
+	settings["index."+name] = value
+}
+
+// PutIndexTemplate installs a composable index template.
+func PutIndexTemplate(options Options, name string, body io.Reader) error {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/_index_template/%s", server, url.PathEscape(name))
+
+	req, err := MakeHTTPRequest(options, "PUT", link, body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient(options).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, resp.Body); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to put index template %s with %s: %s", name, resp.Status, buf.String())
+	}
+	if options.Verbose {
+		log.Printf("put index template %s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+// prepareIndexTemplate installs the index template, if there is one. It is
+// named after the data stream or the index, unless a name is given.
+func prepareIndexTemplate(options Options) error {
+	if options.IndexTemplate == "" {
+		return nil
+	}
+	if options.ServerVersion.Distribution == DistributionElasticsearch && !options.ServerVersion.AtLeast(7, 8) {
+		return fmt.Errorf("composable index templates require elasticsearch 7.8 or later, found %s", options.ServerVersion)
+	}
+	name := options.IndexTemplateName
+	switch {
+	case name != "":
+	case options.DataStream != "":
+		name = options.DataStream
+	case options.Index != "" && !isIndexTemplate(options.Index):
+		name = options.Index
+	default:
+		return fmt.Errorf("an index template name is required")
+	}
+	b, err := readStringOrFile(options.IndexTemplate)
+	if err != nil {
+		return err
+	}
+	return PutIndexTemplate(options, name, bytes.NewReader(b))
+}
@@ -0,0 +1,130 @@
+package esbulk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateIndexBody(t *testing.T) {
+	one := 1
+	var cases = []struct {
+		about   string
+		options Options
+		body    string
+	}{
+		{"nothing to set", Options{}, ""},
+		{
+			"settings",
+			Options{Settings: `{"index": {"number_of_shards": 3, "analysis": {}}}`},
+			`{"settings":{"index":{"analysis":{},"number_of_shards":3}}}`,
+		},
+		{
+			"whole body as settings",
+			Options{Settings: `{"settings": {"number_of_shards": 3}}`, Shards: 2},
+			`{"settings":{"index.number_of_shards":2}}`,
+		},
+		{
+			"shortcuts override settings",
+			Options{Settings: `{"index": {"number_of_shards": 3}}`, Shards: 2, Replicas: &one},
+			`{"settings":{"index":{"number_of_replicas":1,"number_of_shards":2}}}`,
+		},
+		{
+			"typed mapping",
+			Options{Mapping: `{"properties": {}}`, DocType: "doc", ServerVersion: Version{Major: 6}},
+			`{"mappings":{"doc":{"properties":{}}}}`,
+		},
+		{
+			"typeless mapping, unwrapped",
+			Options{Mapping: `{"doc": {"properties": {}}}`, DocType: "doc", Shards: 1, ServerVersion: Version{Major: 7}},
+			`{"mappings":{"properties":{}},"settings":{"index.number_of_shards":1}}`,
+		},
+		{
+			"whole body with mappings and aliases",
+			Options{
+				Settings:      `{"settings": {"number_of_shards": 3}, "mappings": {"properties": {}}, "aliases": {"search": {}}}`,
+				ServerVersion: Version{Major: 7},
+			},
+			`{"aliases":{"search":{}},"mappings":{"properties":{}},"settings":{"number_of_shards":3}}`,
+		},
+		{
+			"whole body with a typed mapping",
+			Options{Settings: `{"mappings": {"properties": {}}}`, DocType: "doc", ServerVersion: Version{Major: 6}},
+			`{"mappings":{"doc":{"properties":{}}}}`,
+		},
+	}
+	for _, c := range cases {
+		body, err := createIndexBody(c.options)
+		if err != nil {
+			t.Errorf("%s: %v", c.about, err)
+			continue
+		}
+		if string(body) != c.body {
+			t.Errorf("%s: got %s, want %s", c.about, body, c.body)
+		}
+	}
+}
+
+func TestCreateIndexBodyErrors(t *testing.T) {
+	for _, options := range []Options{
+		{Settings: `{"settings": {}, "mappings": {"properties": {}}}`, Mapping: `{"properties": {}}`},
+		{Settings: `{"settings": {}, "number_of_shards": 1}`},
+	} {
+		if _, err := createIndexBody(options); err == nil {
+			t.Errorf("expected an error for settings %s and mapping %s", options.Settings, options.Mapping)
+		}
+	}
+}
+
+func TestCreateIndexFromLDJFileSettings(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.NumWorkers = 1
+	options.Index = "missing"
+	options.Mapping = `{"properties": {}}`
+	options.Shards = 4
+	options.IndexTemplate = `{"index_patterns": ["missing*"]}`
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "7.17.0", Major: 7, Minor: 17}
+
+	if _, err := CreateIndexFromLDJFile(strings.NewReader("{\"a\": 1}\n"), options); err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster.find(`PUT /_index_template/missing {"index_patterns"`)) != 1 {
+		t.Errorf("expected the index template to be installed, got %v", cluster.requests)
+	}
+	want := `PUT /missing/ {"mappings":{"properties":{}},"settings":{"index.number_of_shards":4}}`
+	if len(cluster.find(want)) != 1 {
+		t.Errorf("expected the index to be created with settings and mapping, got %v", cluster.requests)
+	}
+	if len(cluster.find("PUT /missing/_mapping")) > 0 {
+		t.Errorf("expected no separate mapping request, got %v", cluster.requests)
+	}
+}
+
+func TestSetBulkSettings(t *testing.T) {
+	cluster := newTestCluster()
+	defer cluster.Close()
+
+	options := getDefaultOptions([]string{cluster.URL})
+	options.Verbose = false
+	options.ZeroReplica = true
+	options.BulkSettings = `{"index": {"translog": {"durability": "async"}}, "refresh_interval": "60s"}`
+
+	restore, err := setBulkSettings(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	settings := cluster.find("PUT /exampleIndex/_settings")
+	want := []string{
+		`PUT /exampleIndex/_settings {"index.number_of_replicas":"0","index.refresh_interval":"60s","index.translog.durability":"async"}`,
+		`PUT /exampleIndex/_settings {"index.number_of_replicas":"1","index.refresh_interval":"30s","index.translog.durability":null}`,
+	}
+	if strings.Join(settings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got settings %q, want %q", settings, want)
+	}
+}
@@ -0,0 +1,106 @@
+package esbulk
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// templatePart is a literal or a field of a template like
+// "{tenant}-{@timestamp:2006.01}".
+type templatePart struct {
+	literal string
+	field   string
+	layout  string // Go time layout, for fields holding a timestamp.
+}
+
+// parseTemplate parses a template, where fields are enclosed in braces and
+// everything else is used literally. A field may be followed by a colon and
+// a Go time layout, e.g. "{@timestamp:2006.01.02}", to format a timestamp.
+// The kind of template, like "id", is used in error messages.
+func parseTemplate(t, kind string) ([]templatePart, error) {
+	var parts []templatePart
+	for len(t) > 0 {
+		i := strings.IndexAny(t, "{}")
+		if i < 0 {
+			parts = append(parts, templatePart{literal: t})
+			break
+		}
+		if t[i] == '}' {
+			return nil, fmt.Errorf("unexpected closing brace in %s template", kind)
+		}
+		if i > 0 {
+			parts = append(parts, templatePart{literal: t[:i]})
+		}
+		j := strings.IndexAny(t[i+1:], "{}")
+		if j < 0 || t[i+1+j] != '}' {
+			return nil, fmt.Errorf("unclosed brace in %s template", kind)
+		}
+		field, layout := t[i+1:i+1+j], ""
+		if k := strings.IndexByte(field, ':'); k >= 0 {
+			field, layout = field[:k], field[k+1:]
+			if layout == "" {
+				return nil, fmt.Errorf("empty time layout in %s template", kind)
+			}
+		}
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, fmt.Errorf("empty field in %s template", kind)
+		}
+		parts = append(parts, templatePart{field: field, layout: layout})
+		t = t[i+j+2:]
+	}
+	return parts, nil
+}
+
+// templateFields returns the fields of a template, in order.
+func templateFields(parts []templatePart) []string {
+	var fields []string
+	for _, p := range parts {
+		if p.field != "" {
+			fields = append(fields, p.field)
+		}
+	}
+	return fields
+}
+
+// timeLayouts are tried in order to parse timestamps given as strings.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// formatTime formats a raw JSON timestamp with a layout, in UTC. Strings are
+// parsed as RFC 3339 or plain dates, numbers are milliseconds since the
+// epoch, like elasticsearch reads them by default.
+func formatTime(raw, layout string) (string, error) {
+	var t time.Time
+	switch c := raw[0]; {
+	case c == '"':
+		s, err := unquote(raw)
+		if err != nil {
+			return "", err
+		}
+		for _, l := range timeLayouts {
+			if t, err = time.ParseInLocation(l, s, time.UTC); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot parse timestamp: %s", s)
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		ms, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsInf(ms, 0) {
+			return "", fmt.Errorf("cannot parse timestamp: %s", raw)
+		}
+		t = time.UnixMilli(int64(ms))
+	default:
+		return "", fmt.Errorf("cannot parse timestamp: %s", raw)
+	}
+	return t.UTC().Format(layout), nil
+}
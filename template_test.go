@@ -0,0 +1,60 @@
+package esbulk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	var cases = []struct {
+		t     string
+		parts []templatePart
+		err   bool
+	}{
+		{"orders", []templatePart{{literal: "orders"}}, false},
+		{"{tenant}-orders", []templatePart{{field: "tenant"}, {literal: "-orders"}}, false},
+		{"events-{@timestamp:2006.01.02}", []templatePart{{literal: "events-"}, {field: "@timestamp", layout: "2006.01.02"}}, false},
+		{"{ts:15:04}", []templatePart{{field: "ts", layout: "15:04"}}, false},
+		{"{ts:}", nil, true},
+		{"{:2006}", nil, true},
+		{"{a", nil, true},
+	}
+	for _, c := range cases {
+		parts, err := parseTemplate(c.t, "index")
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.t, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(parts, c.parts) {
+			t.Errorf("%s: got %+v, want %+v", c.t, parts, c.parts)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	var cases = []struct {
+		raw    string
+		layout string
+		s      string
+		err    bool
+	}{
+		{`"2018-11-13T10:23:00Z"`, "2006.01.02", "2018.11.13", false},
+		{`"2018-11-13T23:30:00-02:00"`, "2006.01.02", "2018.11.14", false},
+		{`"2018-11-13T10:23:00.123"`, "2006-01-02T15", "2018-11-13T10", false},
+		{`"2018-11-13 10:23:00"`, "2006.01", "2018.11", false},
+		{`"2018-11-13"`, "2006", "2018", false},
+		{`1542104580000`, "2006.01.02", "2018.11.13", false},
+		{`"yesterday"`, "2006", "", true},
+		{`true`, "2006", "", true},
+	}
+	for _, c := range cases {
+		s, err := formatTime(c.raw, c.layout)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.raw, err, c.err)
+			continue
+		}
+		if s != c.s {
+			t.Errorf("%s: got %q, want %q", c.raw, s, c.s)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package esbulk
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Distributions, that can be told apart by the root endpoint.
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+)
+
+// Version describes the distribution and version of a cluster.
+type Version struct {
+	Distribution string
+	Number       string
+	Major        int
+	Minor        int
+}
+
+// String returns distribution and version number, e.g. "elasticsearch 6.2.3".
+func (v Version) String() string {
+	return fmt.Sprintf("%s %s", v.Distribution, v.Number)
+}
+
+// Known reports whether the version has been detected.
+func (v Version) Known() bool {
+	return v.Major > 0
+}
+
+// AtLeast reports whether the version is the given one or later.
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Typeless reports whether the cluster has done away with mapping types,
+// which is the case for elasticsearch 7 and later and for all versions of
+// opensearch. An unknown version is assumed to still support types.
+func (v Version) Typeless() bool {
+	if v.Distribution == DistributionOpenSearch {
+		return true
+	}
+	return v.Major >= 7
+}
+
+// GetVersion asks a server for its distribution and version.
+func GetVersion(options Options) (Version, error) {
+	server := PickServerURI(options.Servers)
+	link := fmt.Sprintf("%s/", server)
+
+	req, err := MakeHTTPRequest(options, "GET", link, nil)
+	if err != nil {
+		return Version{}, err
+	}
+	client := httpClient(options)
+	resp, err := client.Do(req)
+	if err != nil {
+		return Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return Version{}, fmt.Errorf("could not get version: %s", resp.Status)
+	}
+
+	// Example response, opensearch adds a "distribution" field.
+	// {
+	//   "name" : "node-1",
+	//   "version" : {
+	//     "distribution" : "opensearch",
+	//     "number" : "2.11.0",
+	//     ...
+	//   },
+	//   "tagline" : "The OpenSearch Project: https://opensearch.org/"
+	// }
+	var doc struct {
+		Version struct {
+			Distribution string `json:"distribution"`
+			Number       string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return Version{}, fmt.Errorf("failed to decode version: %v", err)
+	}
+	return parseVersion(doc.Version.Distribution, doc.Version.Number)
+}
+
+// parseVersion parses a version number like "7.10.2" or "8.0.0-SNAPSHOT".
+func parseVersion(distribution, number string) (Version, error) {
+	if distribution == "" {
+		distribution = DistributionElasticsearch
+	}
+	parts := strings.SplitN(number, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 1 {
+		return Version{}, fmt.Errorf("cannot parse version number: %q", number)
+	}
+	var minor int
+	if len(parts) > 1 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return Version{}, fmt.Errorf("cannot parse version number: %q", number)
+		}
+	}
+	return Version{Distribution: distribution, Number: number, Major: major, Minor: minor}, nil
+}
+
+// detectVersion fills in the server version, unless it is already known. If
+// the version cannot be detected, mapping types are used as before.
+func detectVersion(options Options) Options {
+	if options.ServerVersion.Known() {
+		return options
+	}
+	v, err := GetVersion(options)
+	if err != nil {
+		log.Printf("could not detect server version, assuming mapping types are supported: %v", err)
+		return options
+	}
+	if options.Verbose {
+		log.Printf("detected %s", v)
+	}
+	if v.Typeless() {
+		switch options.DocType {
+		case "", "_doc", "default":
+		default:
+			log.Printf("%s does not support mapping types, ignoring type %q", v, options.DocType)
+		}
+	}
+	options.ServerVersion = v
+	return options
+}
@@ -0,0 +1,72 @@
+package esbulk
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetVersion(t *testing.T) {
+	var cases = []struct {
+		response string
+		version  Version
+		typeless bool
+	}{
+		{
+			`{"name": "n1", "version": {"number": "6.2.3", "lucene_version": "7.2.1"}}`,
+			Version{Distribution: DistributionElasticsearch, Number: "6.2.3", Major: 6, Minor: 2},
+			false,
+		},
+		{
+			`{"name": "n1", "version": {"number": "8.11.1", "build_flavor": "default"}}`,
+			Version{Distribution: DistributionElasticsearch, Number: "8.11.1", Major: 8, Minor: 11},
+			true,
+		},
+		{
+			`{"name": "n1", "version": {"distribution": "opensearch", "number": "2.11.0"}}`,
+			Version{Distribution: DistributionOpenSearch, Number: "2.11.0", Major: 2, Minor: 11},
+			true,
+		},
+	}
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(c.response))
+		}))
+		v, err := GetVersion(getDefaultOptions([]string{server.URL}))
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.version {
+			t.Errorf("Expected %v, got %v", c.version, v)
+		}
+		if v.Typeless() != c.typeless {
+			t.Errorf("Expected typeless %v for %v", c.typeless, v)
+		}
+	}
+}
+
+func TestPutMappingTypeless(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		path, body = req.URL.Path, string(b)
+	}))
+	defer server.Close()
+
+	options := getDefaultOptions([]string{server.URL})
+	options.ServerVersion = Version{Distribution: DistributionElasticsearch, Number: "8.0.0", Major: 8}
+
+	mapping := `{"default": {"properties": {"a": {"type": "keyword"}}}}`
+	if err := PutMapping(options, strings.NewReader(mapping)); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/exampleIndex/_mapping" {
+		t.Errorf("Expected typeless mapping endpoint, got %q", path)
+	}
+	if body != `{"properties": {"a": {"type": "keyword"}}}` {
+		t.Errorf("Expected unwrapped mapping, got %q", body)
+	}
+}